@@ -6,14 +6,18 @@ import (
     "mozilla.org/moztradamus/storage"
 
 
+    "context"
     "flag"
     "fmt"
     "net/http"
     "os"
     "os/signal"
     "runtime"
+    "sort"
+    "strconv"
     "syscall"
     "strings"
+    "time"
 )
 
 var (
@@ -22,7 +26,7 @@ var (
     memProfile *string = flag.String("memProfile", "", "Profile file output")
     logging     * int = flag.Int("logging", 10, "Logging level (0=none...10=verbose")
     logger  *util.HekaLogger
-    store   *storage.Storage
+    store   storage.Storage
 )
 
 
@@ -32,21 +36,114 @@ const (
 )
 
 
+// Config keys a SIGHUP can change. One ending in "." covers every key
+// that starts with it. Anything else needs a restart.
+var reloadable = []string{
+    "logger.filter",
+    "ratelimit.",
+    "db.ttl", "db.ttl.", "db.ttl_min", "db.timeout_live", "db.timeout_del",
+    "db.ttl_forward",
+}
+
+func canReload(key string, keys []string) bool {
+    for _, k := range keys {
+        if key == k || (strings.HasSuffix(k, ".") && strings.HasPrefix(key, k)) {
+            return true
+        }
+    }
+    return false
+}
+
+func copyConfig(config util.JsMap) util.JsMap {
+    dup := make(util.JsMap, len(config))
+    for key, val := range config {
+        dup[key] = val
+    }
+    return dup
+}
+
+// Re-read the config file and apply what can change while running.
+// Returns the settings now in force, to compare the next reload with.
+func reload(path string, loaded util.JsMap, handlers *moztradamus.Handler, store storage.Storage, logger *util.HekaLogger) util.JsMap {
+    // MzGetConfig takes the whole server down if it can't read the file.
+    if _, err := os.Stat(path); err != nil {
+        logger.Error("main", "Could not reload config",
+            util.Fields{"error": err.Error()})
+        return loaded
+    }
+    config := util.MzGetConfig(path)
+    fresh := copyConfig(config)
+
+    if filter, err := strconv.ParseInt(util.MzGet(config, "logger.filter",
+        "10"), 0, 0); err == nil {
+        logger.SetFilter(filter)
+    } else {
+        logger.Error("main", "Invalid logger.filter, leaving it be", nil)
+    }
+    handlers.Reload(config)
+    storage.Reload(store, config)
+    // Plus whatever the presence backend can pick up.
+    backendReloadable := storage.ReloadKeys(store)
+
+    keys := make(map[string]bool)
+    for _, set := range []util.JsMap{loaded, fresh} {
+        for key := range set {
+            keys[key] = true
+        }
+    }
+    var restart []string
+    for key := range keys {
+        if loaded[key] == fresh[key] || canReload(key, reloadable) ||
+            canReload(key, backendReloadable) {
+            continue
+        }
+        restart = append(restart, key)
+        // still the old value, until then.
+        if val, ok := loaded[key]; ok {
+            fresh[key] = val
+        } else {
+            delete(fresh, key)
+        }
+    }
+    if len(restart) > 0 {
+        sort.Strings(restart)
+        logger.Warn("main", "Config reloaded, restart required for some changes",
+            util.Fields{"keys": strings.Join(restart, ",")})
+    } else {
+        logger.Info("main", "Config reloaded", nil)
+    }
+    return fresh
+}
+
 func main() {
     flag.Parse()
 
     // Configuration
     config := util.MzGetConfig(*configFile)
+    // The file as read, before defaults get filled in, to tell what a
+    // reload changed.
+    loaded := copyConfig(config)
     config["VERSION"]=VERSION
     runtime.GOMAXPROCS(runtime.NumCPU())
     logger := util.NewHekaLogger(config)
-    store :=  storage.New(config, logger)
-    handlers := moztradamus.NewHandler(config, store, logger)
+    store, err := storage.New(config, logger)
+    if err != nil {
+        panic ("Storage: " + err.Error())
+    }
+    // Everything that changes presence goes through the broker, so
+    // streams can hear about it.
+    broker := storage.NewBroker(config, logger)
+    store = storage.Publishing(store, broker)
+    handlers, err := moztradamus.NewHandler(config, store, broker, logger)
+    if err != nil {
+        panic ("Handlers: " + err.Error())
+    }
 
 
     // Signal handler
-    sigChan := make(chan os.Signal)
-    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGHUP, SIGUSR1)
+    sigChan := make(chan os.Signal, 1)
+    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
+        SIGUSR1)
 
     // Rest Config
     errChan := make(chan error)
@@ -56,21 +153,65 @@ func main() {
     var verRoot = strings.SplitN(VERSION, ".", 2)[0]
     RESTMux.HandleFunc(fmt.Sprintf("/%s/ping/", verRoot), handlers.PingHandler)
     RESTMux.HandleFunc(fmt.Sprintf("/%s/poll/", verRoot), handlers.PollHandler)
+    RESTMux.HandleFunc(fmt.Sprintf("/%s/revoke/", verRoot), handlers.RevokeHandler)
+    RESTMux.HandleFunc(fmt.Sprintf("/%s/rotate/", verRoot), handlers.RotateHandler)
+    // JSON API
+    RESTMux.HandleFunc("/1/ping/", handlers.V1PingHandler)
+    RESTMux.HandleFunc("/1/poll/", handlers.V1PollHandler)
+    RESTMux.HandleFunc("/1/offline/", handlers.V1OfflineHandler)
+    RESTMux.HandleFunc("/1/revoke/", handlers.V1RevokeHandler)
+    RESTMux.HandleFunc("/1/rotate/", handlers.V1RotateHandler)
+    RESTMux.HandleFunc("/1/stream/", handlers.StreamHandler)
+    RESTMux.HandleFunc("/1/socket/", handlers.SocketHandler)
+    RESTMux.HandleFunc("/1/webhook/", handlers.WebhookHandler)
+    RESTMux.HandleFunc("/1/roster/", handlers.RosterHandler)
+    RESTMux.HandleFunc("/1/grant/", handlers.GrantHandler)
     RESTMux.HandleFunc("/status/", handlers.StatusHandler)
 
+    // How long to wait for requests in flight when shutting down.
+    shutdownTimeout, err := time.ParseDuration(util.MzGet(config,
+        "shutdown.timeout", "30s"))
+    if err != nil {
+        logger.Error("main", "Invalid shutdown.timeout, using 30s", nil)
+        shutdownTimeout = 30 * time.Second
+    }
+    server := &http.Server{Addr: host + ":" + port, Handler: RESTMux}
+    // Streams and long polls would hold up Shutdown to the deadline.
+    server.RegisterOnShutdown(handlers.Drain)
+
     logger.Info("main","startup...", nil)
 
     go func() {
-        errChan <- http.ListenAndServe(host + ":" + port, nil)
+        errChan <- server.ListenAndServe()
     }()
 
-    select {
-    case err := <-errChan:
-        if err != nil {
-            panic ("ListenAndServe: " + err.Error())
+    for running := true; running; {
+        select {
+        case err := <-errChan:
+            if err != nil {
+                panic ("ListenAndServe: " + err.Error())
+            }
+            running = false
+        case sig := <-sigChan:
+            if sig == syscall.SIGHUP {
+                loaded = reload(*configFile, loaded, handlers, store, logger)
+                continue
+            }
+            logger.Info("main", "Shutting down...", nil)
+            running = false
         }
-    case <-sigChan:
-        logger.Info("main", "Shutting down...", nil)
     }
 
+    // Stop taking connections and let the ones in flight finish.
+    ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    if err := server.Shutdown(ctx); err != nil {
+        logger.Error("main", "Requests still running at shutdown",
+            util.Fields{"error": err.Error()})
+    }
+    // (Shutdown doesn't wait for sockets, they're hijacked.)
+    handlers.Close(ctx)
+    cancel()
+    store.Close()
+    logger.Info("main", "Stopped", nil)
+    logger.Close()
 }
@@ -0,0 +1,296 @@
+package moztradamus
+
+// Grants: tokens that only chosen friends can see.
+
+/** A token with no grants is public, as it always was: anyone who knows
+ * it can poll it. Once its owner grants it to other tokens (or just asks
+ * for it to be private, by granting it to no one), it shows up as
+ * "unknown" to everyone but
+ *
+ *  - itself,
+ *  - pollers who show a grantee's token and write key ("as"), and
+ *  - pollers who show a grant for it ("grants"). A grant is handed out
+ *    for each grantee, names that grantee, and is signed, so it can be
+ *    passed along without giving away a write key.
+ *
+ * The grantee list is kept in the presence backend, next to rosters,
+ * and checked on every poll and every streamed event, so taking a
+ * grantee off the list works straight away. Rotating a token carries
+ * its grants over; rotating a grantee doesn't, it has to be granted
+ * again.
+ */
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "net/http"
+)
+
+// Who's looking: a token of their own (if they showed its write key),
+// and any grants they were handed, by granting token.
+type viewer struct {
+    token  string
+    grants map[string]string
+}
+
+type grantRequest struct {
+    Token  string   `json:"token"`
+    Key    string   `json:"key"`
+    Add    []string `json:"add"`
+    Remove []string `json:"remove"`
+}
+
+type grantResponse struct {
+    Token    string            `json:"token"`
+    Grantees []string          `json:"grantees"`
+    // the grant to hand to each grantee.
+    Grants   map[string]string `json:"grants"`
+    // no grants at all, anyone can see it.
+    Public   bool              `json:"public"`
+}
+
+// Where a token's grantees are kept, as a roster. (No roster ID can
+// look like this.)
+func grantsID(token string) []byte {
+    return []byte("grants:" + token)
+}
+
+// Check a viewer's credentials: as (optional) must come with its write
+// key, and grants are keyed by the token they're for.
+func (self *Handler) viewerFor(as *tokenRequest, grants map[string]string) (*viewer, error) {
+    v := &viewer{grants: make(map[string]string)}
+    if as != nil && len(as.Token) > 0 {
+        var err error
+        if v.token, err = self.authorize(as.Token, as.Key); err != nil {
+            return nil, err
+        }
+    }
+    for token, grant := range grants {
+        canon, err := canonicalToken(token)
+        if err != nil {
+            return nil, apiError{"Malformed token: " + token,
+                http.StatusBadRequest}
+        }
+        v.grants[canon] = grant
+    }
+    return v, nil
+}
+
+// The viewer from ?as=<token>, with its key as ?key= or X-Write-Key.
+// (Not FormValue, that would eat the body.)
+func (self *Handler) viewerFrom(req *http.Request) (*viewer, error) {
+    query := req.URL.Query()
+    as := &tokenRequest{Token: query.Get("as"), Key: query.Get("key")}
+    if len(as.Key) == 0 {
+        as.Key = req.Header.Get("X-Write-Key")
+    }
+    return self.viewerFor(as, nil)
+}
+
+// The tokens the viewer counts as, for something asked about as asked.
+func (self *Handler) identities(v *viewer, asked string) []string {
+    var ids []string
+    if v == nil {
+        return ids
+    }
+    if len(v.token) > 0 {
+        ids = append(ids, v.token)
+    }
+    if grant, ok := v.grants[asked]; ok {
+        if grantee, ok := self.keys.checkGrant(asked, grant); ok {
+            ids = append(ids, grantee)
+        }
+    }
+    return ids
+}
+
+// Which of the tokens the viewer may not see. Each was asked about as
+// asked[i] and is current[i] now (they differ if it was rotated); the
+// viewer needs to be allowed both.
+func (self *Handler) hidden(asked, current []string, v *viewer) ([]bool, error) {
+    index := make(map[string]int)
+    var ids [][]byte
+    for i := range asked {
+        for _, token := range []string{asked[i], current[i]} {
+            if _, ok := index[token]; !ok {
+                index[token] = len(ids)
+                ids = append(ids, grantsID(token))
+            }
+        }
+    }
+    lists, err := self.store.GetRosters(ids)
+    if err != nil {
+        return nil, err
+    }
+    hide := make([]bool, len(asked))
+    for i := range asked {
+        who := self.identities(v, asked[i])
+        for _, token := range []string{asked[i], current[i]} {
+            if !allowed(token, lists[index[token]], who) {
+                hide[i] = true
+            }
+        }
+    }
+    return hide, nil
+}
+
+func allowed(token string, grantees [][]byte, who []string) bool {
+    if grantees == nil {
+        return true
+    }
+    for _, id := range who {
+        if id == token {
+            return true
+        }
+        for _, grantee := range grantees {
+            if string(grantee) == id {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Give to the same grantees as from (for a rotation).
+func (self *Handler) copyGrants(from, to string) error {
+    grantees, err := self.store.GetRoster(grantsID(from))
+    if err == storage.ErrNotFound {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return self.store.PutRoster(grantsID(to), grantees)
+}
+
+// Screens live events for a viewer.
+type eventScreen struct {
+    handler *Handler
+    viewer  *viewer
+    // tokens last reported as hidden.
+    hidden  map[string]bool
+}
+
+func (self *Handler) screen(v *viewer) *eventScreen {
+    return &eventScreen{handler: self, viewer: v, hidden: make(map[string]bool)}
+}
+
+// Turn ev into what the viewer may see. Returns false if there's nothing
+// to send: a hidden token gets one "unknown", not one per ping, and a
+// token whose ages are kept vague gets no ping events at all (when one
+// arrives says when it pinged, to the second).
+func (self *eventScreen) pass(ev storage.Event, now int64) (string, streamEvent, bool) {
+    name, reply := streamEventOf(ev, now)
+    current := reply.Token
+    if len(reply.MovedTo) > 0 {
+        current = reply.MovedTo
+    }
+    hide, err := self.handler.hidden([]string{reply.Token},
+        []string{current}, self.viewer)
+    if err != nil {
+        self.handler.logger.Error("grant", "Could not check grants",
+            util.Fields{"token": reply.Token, "error": err.Error()})
+    }
+    if err != nil || hide[0] {
+        if self.hidden[reply.Token] {
+            return "", streamEvent{}, false
+        }
+        self.hidden[reply.Token] = true
+        return stateUnknown, streamEvent{Token: reply.Token,
+            State: stateUnknown}, true
+    }
+    delete(self.hidden, reply.Token)
+    if ev.Kind == storage.EventPing && ev.Presence != nil &&
+        self.handler.privacy.coarsest(ev.Presence.Precision) != storage.PrecisionExact {
+        return "", streamEvent{}, false
+    }
+    // (an invisible token's ping time is as hidden as the rest of it.)
+    if ev.Presence != nil && reply.State != stateUnknown {
+        reply.Age, reply.Freshness, _ = self.handler.freshness(
+            ownerOf(reply.Token, reply.MovedTo), ev.Presence, now)
+    }
+    return name, reply, true
+}
+
+// POST /1/grant/ {"token":..., "key":..., "add":[...], "remove":[...]}
+// changes who a token is granted to. GET /1/grant/<token> lists them,
+// DELETE /1/grant/<token> makes it public again; both with the key, as
+// for DELETE /0/ping/.
+func (self *Handler) GrantHandler(resp http.ResponseWriter, req *http.Request) {
+    var gr grantRequest
+
+    if req.Method == "GET" || req.Method == "DELETE" {
+        gr.Token, gr.Key = pathToken(req.URL.Path), writeKey(req)
+    } else if !self.readJSONUpTo(resp, req, &gr, self.poll.maxBody) {
+        return
+    }
+    reply, err := self.grants(req.Method, &gr)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    self.jsonReply(resp, reply, http.StatusOK)
+}
+
+func (self *Handler) grants(method string, gr *grantRequest) (*grantResponse, error) {
+    token, err := self.authorize(gr.Token, gr.Key)
+    if err != nil {
+        return nil, err
+    }
+    reply := &grantResponse{Token: token,
+        Grantees: []string{},
+        Grants: make(map[string]string)}
+    id := grantsID(token)
+
+    // one change at a time, at least on this node.
+    self.rosterLock.Lock()
+    defer self.rosterLock.Unlock()
+    var grantees []string
+    switch members, err := self.store.GetRoster(id); err {
+    case nil:
+        for _, member := range members {
+            grantees = append(grantees, string(member))
+        }
+    case storage.ErrNotFound:
+        reply.Public = true
+    default:
+        self.logger.Error("grant", "Could not fetch grants",
+            util.Fields{"token": token, "error": err.Error()})
+        return nil, apiError{"Could not fetch grants",
+            http.StatusServiceUnavailable}
+    }
+
+    switch method {
+    case "GET":
+    case "DELETE":
+        err = self.store.DelRoster(id)
+        grantees, reply.Public = nil, true
+    default:
+        // A rotated or revoked token is done with.
+        if err = self.usable(token); err != nil {
+            return nil, err
+        }
+        if grantees, err = self.editRoster(grantees,
+            &rosterRequest{Add: gr.Add, Remove: gr.Remove}); err != nil {
+            return nil, err
+        }
+        err = self.putRoster(string(id), grantees)
+        reply.Public = false
+    }
+    if err != nil {
+        if _, ok := err.(apiError); ok {
+            return nil, err
+        }
+        self.logger.Error("grant", "Could not update grants",
+            util.Fields{"token": token, "error": err.Error()})
+        return nil, apiError{"Could not update grants",
+            http.StatusServiceUnavailable}
+    }
+    for _, grantee := range grantees {
+        reply.Grantees = append(reply.Grantees, grantee)
+        reply.Grants[grantee] = self.keys.grant(token, grantee)
+    }
+    return reply, nil
+}
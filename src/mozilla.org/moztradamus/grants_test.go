@@ -0,0 +1,111 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "net/http"
+    "testing"
+    "time"
+)
+
+// What a poll for token says, with extra in the request.
+func pollState(t *testing.T, h *Handler, token, extra string) string {
+    var poll pollResponse
+    if code := call(t, h.V1PollHandler, `{"tokens":["` + token + `"]` +
+        extra + `}`, &poll); code != http.StatusOK {
+        return http.StatusText(code)
+    }
+    return poll.Results[0].State
+}
+
+func TestGrants(t *testing.T) {
+    h := testHandler(t, nil)
+    var owner, friend pingResponse
+    call(t, h.V1PingHandler, `{}`, &owner)
+    call(t, h.V1PingHandler, `{}`, &friend)
+    auth := `{"token":"` + owner.Token + `","key":"` + owner.Key + `"`
+    asFriend := `,"as":{"token":"` + friend.Token + `","key":"` +
+        friend.Key + `"}`
+
+    if state := pollState(t, h, owner.Token, ""); state != statePresent {
+        t.Fatalf("public: got %s", state)
+    }
+    var granted grantResponse
+    if code := call(t, h.GrantHandler, auth + `,"add":["` + friend.Token +
+        `"]}`, &granted); code != http.StatusOK || granted.Public {
+        t.Fatalf("grant: got %d, %+v", code, granted)
+    }
+    grant := granted.Grants[friend.Token]
+    if code := call(t, h.GrantHandler, `{"token":"` + owner.Token +
+        `","key":"nope","add":["` + friend.Token + `"]}`, nil); code != http.StatusForbidden {
+        t.Errorf("grant with the wrong key: got %d", code)
+    }
+
+    tests := []struct {
+        name  string
+        extra string
+        state string
+    }{
+        {"stranger", "", stateUnknown},
+        {"as the grantee", asFriend, statePresent},
+        {"as the grantee, wrong key", `,"as":{"token":"` + friend.Token +
+            `","key":"nope"}`, http.StatusText(http.StatusForbidden)},
+        {"with the grant", `,"grants":{"` + owner.Token + `":"` + grant +
+            `"}`, statePresent},
+        {"with a forged grant", `,"grants":{"` + owner.Token + `":"AAAA` +
+            grant[4:] + `"}`, stateUnknown},
+    }
+    for _, test := range tests {
+        if state := pollState(t, h, owner.Token, test.extra); state != test.state {
+            t.Errorf("%s: got %s, want %s", test.name, state, test.state)
+        }
+    }
+
+    // taking the grantee off works straight away.
+    call(t, h.GrantHandler, auth + `,"remove":["` + friend.Token + `"]}`,
+        nil)
+    if state := pollState(t, h, owner.Token, asFriend); state != stateUnknown {
+        t.Errorf("removed grantee: got %s", state)
+    }
+    // and deleting the grants makes it public again.
+    if code := callPath(t, h.GrantHandler, "DELETE", "/1/grant/" +
+        owner.Token + "?key=" + owner.Key, nil); code != http.StatusOK {
+        t.Errorf("delete: got %d", code)
+    }
+    if state := pollState(t, h, owner.Token, ""); state != statePresent {
+        t.Errorf("public again: got %s", state)
+    }
+}
+
+// Ping events would say to the second when a token pinged, so only
+// tokens with exact ages get them.
+func TestScreenPings(t *testing.T) {
+    now := time.Now().UTC().Unix()
+    token := "8NPm7b8iprM-zaAIW6nZ1g"
+    tests := []struct {
+        mode      string
+        precision string
+        kind      string
+        pass      bool
+    }{
+        {"exact", "", storage.EventPing, true},
+        {"exact", storage.PrecisionBucket, storage.EventPing, false},
+        {"exact", storage.PrecisionJitter, storage.EventPing, false},
+        {"bucket", "", storage.EventPing, false},
+        {"jitter", "", storage.EventPing, false},
+        // other events still go through, vaguely.
+        {"bucket", "", storage.EventStatus, true},
+    }
+    for _, test := range tests {
+        h := testHandler(t, util.JsMap{"privacy.mode": test.mode})
+        ev := storage.Event{Token: []byte(token), Kind: test.kind,
+            Presence: &storage.Presence{Last: now - 10,
+                Precision: test.precision}}
+        _, _, ok := h.screen(&viewer{}).pass(ev, now)
+        if ok != test.pass {
+            t.Errorf("%s/%q %s: got %v, want %v", test.mode,
+                test.precision, test.kind, ok, test.pass)
+        }
+    }
+}
@@ -4,29 +4,149 @@ import(
     "mozilla.org/util"
     "mozilla.org/moztradamus/storage"
 
-    "crypto/rand"
-    "encoding/base64"
+    "context"
     "encoding/json"
     "net/http"
     // "net/url"
-    "io"
     "fmt"
-    "math"
+    "strconv"
     "strings"
     "log"
+    "sync"
     "time"
 )
 
+// Token states reported by /poll/.
+const (
+    statePresent = "present"
+    // pinged, but not within its TTL.
+    stateExpired = "expired"
+    // never seen, long gone or invisible.
+    stateUnknown = "unknown"
+    // went offline on purpose.
+    stateOffline = "offline"
+    // retired for good.
+    stateRevoked = "revoked"
+    // couldn't tell, the backend failed.
+    stateError   = "error"
+)
+
+// Most rotations in a row /poll/ will follow.
+const maxForwards = 3
+
+// What /poll/ reports for each token.
+type pollReply struct {
+    State     string `json:"state"`
+    Age       *int64 `json:"age,omitempty"`
+    // in place of age, if it's being kept vague.
+    Freshness string `json:"freshness,omitempty"`
+    Status    string `json:"status,omitempty"`
+    Message   string `json:"message,omitempty"`
+    // the token was rotated; the rest is about this one.
+    MovedTo   string `json:"moved_to,omitempty"`
+}
+
 type Handler struct {
     config util.JsMap
     logger *util.HekaLogger
-    store  *storage.Storage
+    store  storage.Storage
+    broker *storage.Broker
+    // (SIGHUP may replace it; see policy.)
+    ttls   *storage.TTLPolicy
+    ttlLock sync.RWMutex
+    keys   *tokenKeys
+    stream streamConfig
+    // longest a /poll/ may wait for a change.
+    maxWait time.Duration
+    poll    pollLimits
+    privacy privacyConfig
+    // nil unless webhook.enabled.
+    hooks  *webhooks
+    // most tokens in a roster.
+    rosterMax  int
+    rosterLock sync.Mutex
+    limits *rateLimits
+    // closed when the server is shutting down.
+    closing chan bool
+    sockets sync.WaitGroup
+    // (so no socket is counted in once Close is waiting.)
+    socketLock sync.Mutex
 }
 
-func NewHandler(config util.JsMap, store *storage.Storage, logger *util.HekaLogger) *Handler {
-    return &Handler{config: config,
+// store should publish to broker (see storage.Publishing), or streams
+// will never hear about anything. Fails if there's no key to sign
+// tokens with.
+func NewHandler(config util.JsMap, store storage.Storage, broker *storage.Broker, logger *util.HekaLogger) (*Handler, error) {
+    keys, err := newTokenKeys(config, logger)
+    if err != nil {
+        return nil, err
+    }
+    self := &Handler{config: config,
         store: store,
+        broker: broker,
+        ttls: storage.NewTTLPolicy(config, logger),
+        keys: keys,
+        stream: newStreamConfig(config, logger),
+        maxWait: parseMaxWait(config, logger),
+        poll: newPollLimits(config, logger),
+        privacy: newPrivacyConfig(config, logger),
+        rosterMax: parseRosterMax(config, logger),
+        limits: newRateLimits(config, logger),
+        closing: make(chan bool),
         logger: logger}
+    self.hooks = newWebhooks(config, self, logger)
+    return self, nil
+}
+
+// Tell streams, sockets and long polls to wrap up, since the server is
+// going away. (They'd keep http.Server.Shutdown waiting otherwise.)
+func (self *Handler) Drain() {
+    self.socketLock.Lock()
+    defer self.socketLock.Unlock()
+    select {
+    case <-self.closing:
+    default:
+        close(self.closing)
+    }
+}
+
+// Stop everything running in the background. Call once the server has
+// stopped taking requests, and before closing the store. Sockets still
+// open when ctx is done are left to it.
+func (self *Handler) Close(ctx context.Context) {
+    self.Drain()
+    // sockets take their tokens offline on the way out.
+    closed := make(chan bool)
+    go func() {
+        self.sockets.Wait()
+        close(closed)
+    }()
+    select {
+    case <-closed:
+    case <-ctx.Done():
+        self.logger.Warn("handler", "Sockets still open at shutdown", nil)
+    }
+    if self.hooks != nil {
+        self.hooks.Close()
+    }
+    self.limits.Close()
+}
+
+// Pick up the settings that can change while running: TTLs and rate
+// limits.
+func (self *Handler) Reload(config util.JsMap) {
+    ttls := storage.NewTTLPolicy(config, self.logger)
+    self.ttlLock.Lock()
+    self.ttls = ttls
+    self.ttlLock.Unlock()
+    self.limits.configure(config, self.logger)
+}
+
+// The TTL policy in force.
+func (self *Handler) policy() *storage.TTLPolicy {
+    self.ttlLock.RLock()
+    defer self.ttlLock.RUnlock()
+    return self.ttls
 }
 
 func (self *Handler) err(resp http.ResponseWriter, msg string, status int) {
@@ -38,75 +158,506 @@ func (self *Handler) err(resp http.ResponseWriter, msg string, status int) {
 }
 
 
-func (self *Handler) newToken() (string, error) {
+// Mint a new (signed) presence ID and the write key that goes with it.
+func (self *Handler) newToken() (id, key string, err error) {
 
-    token := make([]byte, 16)
-    n, err := rand.Read(token)
-    if n != len(token) || err != nil {
+    if id, err = self.keys.mint(); err != nil {
+        return "", "", err
+    }
+    return id, self.keys.writeKey(id), nil
+}
+
+// A ping, however it arrived.
+type pingRequest struct {
+    Token     string `json:"token"`
+    Key       string `json:"key"`
+    TTL       int64  `json:"ttl"`
+    Class     string `json:"class"`
+    Status    string `json:"status"`
+    Message   string `json:"message"`
+    // how precisely polls may show its age; see privacy.go.
+    Precision string `json:"precision"`
+}
+
+// An error, and the HTTP status to report it with.
+type apiError struct {
+    msg    string
+    status int
+}
+
+func (e apiError) Error() string {
+    return e.msg
+}
+
+// Check that token is one of ours and key is its write key. Returns
+// the token in its current form, which is what gets stored.
+func (self *Handler) authorize(token, key string) (string, error) {
+    canon, err := canonicalToken(token)
+    if err != nil {
+        return "", err
+    }
+    // Turn away anything we didn't issue before it gets near storage.
+    if _, err := self.keys.verify(canon); err != nil {
         return "", err
     }
-    return base64.StdEncoding.EncodeToString(token), nil
+    if !self.keys.check(token, key) {
+        return "", apiError{"Invalid write key", http.StatusForbidden}
+    }
+    return canon, nil
 }
 
-func (self *Handler) PingHandler(resp http.ResponseWriter, req *http.Request) {
-    var token string
+// Can the token still be pinged? Revoked and rotated tokens can't.
+func (self *Handler) usable(token string) error {
+    _, err := self.store.CheckPing([]byte(token))
+    return refusal(err)
+}
+
+// The API error for a store error that says the token can't be
+// written to any more, or nil. (The store has the last word, if it was
+// revoked after usable looked.)
+func refusal(err error) error {
+    switch err {
+    case storage.ErrRevoked:
+        return apiError{"Token revoked", http.StatusForbidden}
+    case storage.ErrMoved:
+        return apiError{"Token has been rotated", http.StatusGone}
+    }
+    return nil
+}
+
+// Check a ping and record it. A new token (and write key) is minted if
+// the ping didn't carry one, otherwise the write key must match.
+func (self *Handler) register(ping *pingRequest) (*storage.Presence, error) {
+    // Optional status and message, defaulting to plain "online".
+    status := strings.ToLower(ping.Status)
+    if len(status) == 0 {
+        status = storage.StatusOnline
+    }
+    if !storage.ValidStatus(status) {
+        return nil, apiError{"Invalid status", http.StatusBadRequest}
+    }
+    precision := strings.ToLower(ping.Precision)
+    if len(precision) > 0 && !storage.ValidPrecision(precision) {
+        return nil, apiError{"Invalid precision", http.StatusBadRequest}
+    }
+    if len(ping.Message) > storage.MaxMessageLen {
+        return nil, apiError{"Status message too long", http.StatusBadRequest}
+    }
+    if ping.TTL < 0 {
+        return nil, apiError{"Invalid ttl", http.StatusBadRequest}
+    }
+
+    // Clients may ask for a TTL (in seconds) and/or a token class. The
+    // TTL policy keeps them in bounds. The status doubles as the class
+    // if none was given.
+    class := ping.Class
+    if len(class) == 0 {
+        class = status
+    }
+    presence := &storage.Presence{
+        TTL: self.policy().Effective(class, time.Duration(ping.TTL) * time.Second),
+        Status: status,
+        Message: ping.Message,
+        Precision: precision}
 
-    elements := strings.Split(req.URL.Path,"/")
-    log.Printf("elements: %v, %d, %s", elements, len(elements), elements[3])
-    if len(elements[3]) == 0 {
-        token, _ = self.newToken()
-        log.Printf("New token: %s", token)
+    if len(ping.Token) == 0 {
+        var err error
+        if ping.Token, ping.Key, err = self.newToken(); err != nil {
+            return nil, apiError{"Could not create token",
+                http.StatusInternalServerError}
+        }
+        log.Printf("New token: %s", ping.Token)
     } else {
-        maxLen := int(math.Min(float64(25), float64(len(elements[3]))))
-        log.Printf("maxLen %d", maxLen)
-        token = elements[3][0:maxLen]
-        log.Printf("maxLen %s", token)
+        var err error
+        if ping.Token, err = self.authorize(ping.Token, ping.Key); err != nil {
+            return nil, err
+        }
+        if err := self.usable(ping.Token); err != nil {
+            return nil, err
+        }
+    }
+    if err := self.store.RegPing([]byte(ping.Token), presence); err != nil {
+        if rerr := refusal(err); rerr != nil {
+            return nil, rerr
+        }
+        return nil, apiError{
+            fmt.Sprintf("Could not register token %s", ping.Token),
+            http.StatusInternalServerError}
     }
+    return presence, nil
+}
 
-    err := self.store.RegPing([]byte(token))
+// Take a token offline (revoke false) or retire it for good (revoke
+// true). Either way the write key must match. Returns the token in its
+// current form.
+func (self *Handler) retire(token, key string, revoke bool) (string, error) {
+    if len(token) == 0 {
+        return "", apiError{"Missing token", http.StatusBadRequest}
+    }
+    token, err := self.authorize(token, key)
     if err != nil {
-        http.Error(resp,
-            fmt.Sprintf("Could not register token %s", token),
-            500)
+        return "", err
+    }
+    // Going offline mustn't undo a revoke or rotation.
+    if !revoke {
+        if err = self.usable(token); err != nil {
+            return "", err
+        }
+    }
+    if revoke {
+        err = self.store.Revoke([]byte(token))
+    } else {
+        err = self.store.Drop([]byte(token), self.policy().Offline)
+    }
+    if rerr := refusal(err); rerr != nil {
+        return "", rerr
+    }
+    if err == storage.ErrFull {
+        return "", apiError{"Too many revoked tokens",
+            http.StatusServiceUnavailable}
+    }
+    if err != nil {
+        self.logger.Error("handler", "Could not retire token",
+            util.Fields{"token": token,
+                "revoke": strconv.FormatBool(revoke),
+                "error": err.Error()})
+        return "", apiError{
+            fmt.Sprintf("Could not update token %s", token),
+            http.StatusInternalServerError}
+    }
+    return token, nil
+}
+
+// Replace token with a new one, carrying its presence over. Polls for
+// the old token are pointed at the new one for db.ttl_forward, and after
+// that it's as good as revoked.
+func (self *Handler) rotate(token, key string) (newToken, newKey string, err error) {
+    if len(token) == 0 {
+        return "", "", apiError{"Missing token", http.StatusBadRequest}
+    }
+    if token, err = self.authorize(token, key); err != nil {
+        return "", "", err
+    }
+    if err = self.usable(token); err != nil {
+        return "", "", err
+    }
+    if newToken, newKey, err = self.newToken(); err != nil {
+        return "", "", apiError{"Could not create token",
+            http.StatusInternalServerError}
+    }
+    // Its grants go with it, before there's anything to see.
+    if err = self.copyGrants(token, newToken); err != nil {
+        self.logger.Error("handler", "Could not copy grants",
+            util.Fields{"token": token, "error": err.Error()})
+        return "", "", apiError{
+            fmt.Sprintf("Could not rotate token %s", token),
+            http.StatusInternalServerError}
+    }
+    // The old ping goes with it, as it was (when, and for how long), so
+    // there's no gap.
+    old, err := self.store.CheckPing([]byte(token))
+    switch err {
+    case nil:
+        err = self.store.RegPing([]byte(newToken),
+            &storage.Presence{Last: old.Last,
+                TTL: old.TTL,
+                Status: old.Status,
+                Message: old.Message,
+                Precision: old.Precision})
+    case storage.ErrExpired, storage.ErrNotFound, storage.ErrOffline:
+        // nothing to carry over.
+        err = nil
+    }
+    if err == nil {
+        err = self.store.Forward([]byte(token), []byte(newToken),
+            self.policy().Forward)
+    }
+    if rerr := refusal(err); rerr != nil {
+        return "", "", rerr
+    }
+    if err == storage.ErrFull {
+        return "", "", apiError{"Too many retired tokens",
+            http.StatusServiceUnavailable}
+    }
+    if err != nil {
+        self.logger.Error("handler", "Could not rotate token",
+            util.Fields{"token": token, "error": err.Error()})
+        return "", "", apiError{
+            fmt.Sprintf("Could not rotate token %s", token),
+            http.StatusInternalServerError}
+    }
+    return newToken, newKey, nil
+}
+
+// The token from a /0/<verb>/<token> path.
+func pathToken(path string) string {
+    // Old style tokens may contain "/", so take everything after the
+    // verb.
+    elements := strings.SplitN(path, "/", 4)
+    if len(elements) < 4 {
+        return ""
+    }
+    return elements[3]
+}
+
+// The write key, as ?key= or a header.
+func writeKey(req *http.Request) string {
+    if key := req.FormValue("key"); len(key) > 0 {
+        return key
+    }
+    return req.Header.Get("X-Write-Key")
+}
+
+func (self *Handler) PingHandler(resp http.ResponseWriter, req *http.Request) {
+    var ping pingRequest
+
+    if !self.allowRequest(resp, req, self.err) {
+        return
+    }
+    ping.Token = pathToken(req.URL.Path)
+    ping.Key = writeKey(req)
+    // DELETE /0/ping/<token> goes offline.
+    if req.Method == "DELETE" {
+        token, err := self.retire(ping.Token, ping.Key, false)
+        if err != nil {
+            aerr := err.(apiError)
+            self.err(resp, aerr.msg, aerr.status)
+            return
+        }
+        resp.Write([]byte(token+"\n"))
+        return
+    }
+
+    if ttl := req.FormValue("ttl"); len(ttl) > 0 {
+        var err error
+        if ping.TTL, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+            self.err(resp, "Invalid ttl", http.StatusBadRequest)
+            return
+        }
+    }
+    ping.Class = req.FormValue("class")
+    ping.Status = req.FormValue("status")
+    ping.Message = req.FormValue("message")
+    ping.Precision = req.FormValue("precision")
+
+    if !self.allowPing(resp, ping.Token, ping.Key, self.err) {
+        return
+    }
+    presence, err := self.register(&ping)
+    if err != nil {
+        aerr := err.(apiError)
+        self.err(resp, aerr.msg, aerr.status)
         return
     }
     // token := elements[len(elements)-1]
 
+    resp.Header().Set("X-Presence-TTL",
+        strconv.FormatInt(int64(presence.TTL / time.Second), 10))
+    resp.Header().Set("X-Write-Key", ping.Key)
+    resp.Write([]byte(ping.Token+"\n"))
+}
+
+// POST /0/rotate/<token> swaps the token for a new one. The new write
+// key comes back in X-Write-Key, as for a new ping.
+func (self *Handler) RotateHandler(resp http.ResponseWriter, req *http.Request) {
+    if req.Method != "POST" {
+        self.err(resp, "", http.StatusMethodNotAllowed)
+        return
+    }
+    token, key, err := self.rotate(pathToken(req.URL.Path), writeKey(req))
+    if err != nil {
+        aerr := err.(apiError)
+        self.err(resp, aerr.msg, aerr.status)
+        return
+    }
+    resp.Header().Set("X-Write-Key", key)
     resp.Write([]byte(token+"\n"))
 }
 
+// POST /0/revoke/<token> retires a (leaked) token for good.
+func (self *Handler) RevokeHandler(resp http.ResponseWriter, req *http.Request) {
+    if req.Method != "POST" {
+        self.err(resp, "", http.StatusMethodNotAllowed)
+        return
+    }
+    token, err := self.retire(pathToken(req.URL.Path), writeKey(req), true)
+    if err != nil {
+        aerr := err.(apiError)
+        self.err(resp, aerr.msg, aerr.status)
+        return
+    }
+    resp.Write([]byte(token+"\n"))
+}
+
+
+// Look tokens up and work out which state to report each in. A
+// presence is only returned for present, expired and offline tokens.
+// Rotated tokens are followed, and what's reported is about the token
+// in movedTo. Tokens v hasn't been granted look unknown.
+func (self *Handler) lookup(tokens []string, v *viewer) (states []string, presences []*storage.Presence, movedTo []string) {
+    states = make([]string, len(tokens))
+    presences = make([]*storage.Presence, len(tokens))
+    movedTo = make([]string, len(tokens))
+
+    current := append([]string(nil), tokens...)
+    pending := make([]int, len(tokens))
+    for i := range pending {
+        pending[i] = i
+    }
+    for hop := 0; len(pending) > 0; hop++ {
+        pks := make([][]byte, len(pending))
+        for j, i := range pending {
+            pks[j] = []byte(current[i])
+        }
+        results, err := self.store.CheckPings(pks)
+        if err != nil {
+            self.logger.Error("poll", "Could not check tokens",
+                util.Fields{"count": strconv.Itoa(len(pks)),
+                    "error": err.Error()})
+            for _, i := range pending {
+                states[i] = stateError
+            }
+            break
+        }
+        var next []int
+        for j, i := range pending {
+            result := results[j]
+            if result.Err == storage.ErrMoved && hop < maxForwards {
+                current[i] = string(result.Presence.MovedTo)
+                movedTo[i] = current[i]
+                next = append(next, i)
+                continue
+            }
+            states[i], presences[i] = self.state(current[i], result)
+        }
+        pending = next
+    }
+
+    hide, err := self.hidden(tokens, current, v)
+    if err != nil {
+        self.logger.Error("poll", "Could not check grants",
+            util.Fields{"count": strconv.Itoa(len(tokens)),
+                "error": err.Error()})
+    }
+    for i := range tokens {
+        switch {
+        case err != nil:
+            states[i] = stateError
+        case hide[i]:
+            states[i] = stateUnknown
+        default:
+            continue
+        }
+        presences[i], movedTo[i] = nil, ""
+    }
+    return states, presences, movedTo
+}
+
+// The state to report for one CheckPings result.
+func (self *Handler) state(token string, result storage.Result) (string, *storage.Presence) {
+    // invisible tokens look just like ones we know nothing about.
+    if result.Presence != nil &&
+        result.Presence.Status == storage.StatusInvisible {
+        return stateUnknown, nil
+    }
+    switch result.Err {
+    case nil:
+        return statePresent, result.Presence
+    case storage.ErrExpired:
+        return stateExpired, result.Presence
+    case storage.ErrOffline:
+        return stateOffline, result.Presence
+    case storage.ErrRevoked:
+        return stateRevoked, nil
+    case storage.ErrNotFound, storage.ErrMoved:
+        // (too many rotations in a row to follow)
+        return stateUnknown, nil
+    }
+    self.logger.Error("poll", "Could not check token",
+        util.Fields{"token": token,
+            "error": result.Err.Error()})
+    return stateError, nil
+}
 
 func (self *Handler) PollHandler(resp http.ResponseWriter, req *http.Request) {
-    var result map[string]int
+    var result map[string]pollReply
+    var waitSecs int64
 
-    result = make(map[string]int)
+    result = make(map[string]pollReply)
 
     // get the list of ids to poll
     if req.Method != "POST" {
         self.err(resp, "", http.StatusMethodNotAllowed)
         return
     }
-    // read up to 10MB of data:
-    body := make([]byte, 10485760)
-    blen, _ := io.ReadFull(req.Body, body)
-    body = body[:blen]
-    log.Printf("Body: %q", body)
-    for _ , item := range strings.Split(string(body), ",") {
-        item := strings.TrimSpace(item)
-        self.logger.Info("poll", item, nil)
-        lastPing, err := self.store.CheckPing([]byte(item))
-        if err != nil {
-            self.logger.Error("poll",
-                fmt.Sprintf("Item not found %s", item),
-                nil)
-            delete (result, item)
-            continue
-        } else {
-            result[item]=int(time.Now().UTC().Unix() - lastPing)
+    if !self.allowRequest(resp, req, self.err) {
+        return
+    }
+    // ?since=<version>&wait=<seconds> to long poll. (Not FormValue, that
+    // would eat the body.)
+    query := req.URL.Query()
+    if w := query.Get("wait"); len(w) > 0 {
+        var err error
+        if waitSecs, err = strconv.ParseInt(w, 10, 64); err != nil {
+            self.err(resp, "Invalid wait", http.StatusBadRequest)
+            return
+        }
+    }
+    wait, err := self.pollWait(waitSecs)
+    if err != nil {
+        self.err(resp, err.Error(), http.StatusBadRequest)
+        return
+    }
+    // ?as=<token>&key=<write key> to see tokens granted to it.
+    v, err := self.viewerFrom(req)
+    if err != nil {
+        aerr := err.(apiError)
+        self.err(resp, aerr.msg, aerr.status)
+        return
+    }
+    var items, tokens []string
+    if roster := query.Get("roster"); len(roster) > 0 {
+        // ?roster=<id> polls its members; there's no body.
+        if tokens, err = self.rosterTokens(roster); err != nil {
+            aerr := err.(apiError)
+            self.err(resp, aerr.msg, aerr.status)
+            return
+        }
+        items = tokens
+    } else {
+        if items, err = self.readPollBody(req); err != nil {
+            aerr := err.(apiError)
+            self.err(resp, aerr.msg, aerr.status)
+            return
+        }
+        if tokens, err = canonicalTokens(items); err != nil {
+            self.err(resp, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+    if !self.allowPoll(resp, req, len(tokens), self.err) {
+        return
+    }
+    states, presences, movedTo, version := self.lookupChanged(req, tokens, v,
+        query.Get("since"), wait)
+    now := time.Now().UTC().Unix()
+    for i, item := range items {
+        state, presence := states[i], presences[i]
+        reply := pollReply{State: state, MovedTo: movedTo[i]}
+        if presence != nil {
+            reply.Age, reply.Freshness, _ = self.freshness(
+                ownerOf(tokens[i], movedTo[i]), presence, now)
+        }
+        // the status of an expired token is stale, so leave it out.
+        if state == statePresent {
+            reply.Status = presence.Status
+            reply.Message = presence.Message
         }
+        result[item] = reply
     }
 
     reply,_ := json.Marshal(result)
+    resp.Header().Set("X-Poll-Version", version)
     resp.Write(reply)
     resp.Write([]byte("\n"))
 }
@@ -0,0 +1,280 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "io/ioutil"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testLogger() *util.HekaLogger {
+    return util.NewHekaLogger(util.JsMap{"logger.filter": "0"})
+}
+
+// A Handler on the memory backend, as main would set it up.
+func testHandler(t *testing.T, extra util.JsMap) *Handler {
+    handler := openHandler(t, extra)
+    t.Cleanup(func() {
+        handler.Close(context.Background())
+        handler.store.Close()
+    })
+    return handler
+}
+
+// testHandler, for tests that close it themselves.
+func openHandler(t *testing.T, extra util.JsMap) *Handler {
+    config := util.JsMap{"db.backend": "memory", "token.keys": "1:test"}
+    for key, val := range extra {
+        config[key] = val
+    }
+    logger := testLogger()
+    store, err := storage.New(config, logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    broker := storage.NewBroker(config, logger)
+    store = storage.Publishing(store, broker)
+    handler, err := NewHandler(config, store, broker, logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return handler
+}
+
+// POST body to handler, and decode the JSON reply into reply.
+func call(t *testing.T, handler http.HandlerFunc, body string, reply interface{}) int {
+    resp := httptest.NewRecorder()
+    handler(resp, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+    if reply != nil {
+        if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+            t.Fatalf("%s: %s", err, resp.Body.String())
+        }
+    }
+    return resp.Code
+}
+
+func TestV1PingPoll(t *testing.T) {
+    h := testHandler(t, nil)
+
+    var ping pingResponse
+    if code := call(t, h.V1PingHandler, `{"status":"away","message":"hi"}`,
+        &ping); code != http.StatusOK {
+        t.Fatalf("new token: got %d", code)
+    }
+    if len(ping.Token) == 0 || len(ping.Key) == 0 || ping.Status != "away" {
+        t.Fatalf("new token: got %+v", ping)
+    }
+    other, _ := h.keys.mint()
+
+    tests := []struct {
+        name    string
+        handler http.HandlerFunc
+        body    string
+        status  int
+        // what a poll for both tokens says after.
+        states  []string
+    }{
+        {"poll", nil, "", http.StatusOK,
+            []string{statePresent, stateUnknown}},
+        {"wrong key", h.V1PingHandler,
+            `{"token":"` + ping.Token + `","key":"nope"}`,
+            http.StatusForbidden, []string{statePresent, stateUnknown}},
+        {"forged token", h.V1PingHandler,
+            `{"token":"AAAA` + ping.Token[4:] + `","key":"` + ping.Key + `"}`,
+            http.StatusForbidden, []string{statePresent, stateUnknown}},
+        {"offline", h.V1OfflineHandler,
+            `{"token":"` + ping.Token + `","key":"` + ping.Key + `"}`,
+            http.StatusOK, []string{stateOffline, stateUnknown}},
+        {"ping again", h.V1PingHandler,
+            `{"token":"` + ping.Token + `","key":"` + ping.Key + `"}`,
+            http.StatusOK, []string{statePresent, stateUnknown}},
+        {"revoke", h.V1RevokeHandler,
+            `{"token":"` + ping.Token + `","key":"` + ping.Key + `"}`,
+            http.StatusOK, []string{stateRevoked, stateUnknown}},
+        {"ping revoked", h.V1PingHandler,
+            `{"token":"` + ping.Token + `","key":"` + ping.Key + `"}`,
+            http.StatusForbidden, []string{stateRevoked, stateUnknown}},
+    }
+    for _, test := range tests {
+        if test.handler != nil {
+            if code := call(t, test.handler, test.body, nil); code != test.status {
+                t.Errorf("%s: got %d, want %d", test.name, code, test.status)
+            }
+        }
+        var poll pollResponse
+        if code := call(t, h.V1PollHandler,
+            `{"tokens":["` + ping.Token + `","` + other + `"]}`,
+            &poll); code != http.StatusOK {
+            t.Fatalf("%s: poll got %d", test.name, code)
+        }
+        for i, result := range poll.Results {
+            if result.State != test.states[i] {
+                t.Errorf("%s: token %d is %q, want %q", test.name, i,
+                    result.State, test.states[i])
+            }
+            if result.Found != (result.State == statePresent) {
+                t.Errorf("%s: token %d found is %v", test.name, i,
+                    result.Found)
+            }
+        }
+    }
+}
+
+func TestV1PollErrors(t *testing.T) {
+    h := testHandler(t, util.JsMap{"poll.max_body": "64",
+        "poll.max_tokens": "2"})
+    token, _ := h.keys.mint()
+
+    tests := []struct {
+        name   string
+        body   string
+        status int
+    }{
+        {"bad JSON", `{"tokens":`, http.StatusBadRequest},
+        {"malformed token", `{"tokens":["not a token!"]}`,
+            http.StatusBadRequest},
+        {"too many tokens", `{"tokens":["a","b","c"]}`,
+            http.StatusRequestEntityTooLarge},
+        {"body too large", `{"tokens":["` + token + `","` + token + `"]}`,
+            http.StatusRequestEntityTooLarge},
+        {"tokens and roster", `{"tokens":["a"],"roster":"b"}`,
+            http.StatusBadRequest},
+    }
+    for _, test := range tests {
+        var reply errorResponse
+        if code := call(t, h.V1PollHandler, test.body, &reply); code != test.status {
+            t.Errorf("%s: got %d, want %d", test.name, code, test.status)
+        }
+        if reply.Status != test.status || len(reply.Error) == 0 {
+            t.Errorf("%s: got error reply %+v", test.name, reply)
+        }
+    }
+}
+
+func TestV1Rotate(t *testing.T) {
+    h := testHandler(t, nil)
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{"status":"busy"}`, &ping)
+    before, _ := h.store.CheckPing([]byte(ping.Token))
+    auth := `{"token":"` + ping.Token + `","key":"` + ping.Key + `"}`
+
+    var rotated rotateResponse
+    if code := call(t, h.V1RotateHandler, auth, &rotated); code != http.StatusOK {
+        t.Fatalf("rotate: got %d", code)
+    }
+    if rotated.Replaces != ping.Token || rotated.Token == ping.Token {
+        t.Fatalf("rotate: got %+v", rotated)
+    }
+    // the ping is carried over as it was, not made fresh.
+    after, err := h.store.CheckPing([]byte(rotated.Token))
+    if err != nil || after.Last != before.Last || after.TTL != before.TTL ||
+        after.Status != "busy" {
+        t.Errorf("new token: got (%+v, %v), want %+v", after, err, before)
+    }
+    if code := call(t, h.V1PingHandler, auth, nil); code != http.StatusGone {
+        t.Errorf("ping old token: got %d, want 410", code)
+    }
+    if code := call(t, h.V1RotateHandler, auth, nil); code != http.StatusGone {
+        t.Errorf("rotate again: got %d, want 410", code)
+    }
+    var poll pollResponse
+    call(t, h.V1PollHandler, `{"tokens":["` + ping.Token + `"]}`, &poll)
+    if poll.Results[0].MovedTo != rotated.Token || !poll.Results[0].Found {
+        t.Errorf("poll old token: got %+v", poll.Results[0])
+    }
+}
+
+// A reload changes the TTLs and rate limits for the next request.
+func TestReload(t *testing.T) {
+    h := testHandler(t, util.JsMap{"db.ttl": "900"})
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{}`, &ping)
+    if ping.TTL != 900 {
+        t.Fatalf("before: got ttl %d", ping.TTL)
+    }
+    h.Reload(util.JsMap{"db.ttl": "120", "ratelimit.ip.rate": "0.001",
+        "ratelimit.ip.burst": "1"})
+    if code := call(t, h.V1PingHandler, `{}`, &ping); code != http.StatusOK ||
+        ping.TTL != 120 {
+        t.Errorf("after: got %d, ttl %d", code, ping.TTL)
+    }
+    if code := call(t, h.V1PingHandler, `{}`, nil); code != http.StatusTooManyRequests {
+        t.Errorf("over the new limit: got %d, want 429", code)
+    }
+}
+
+// Close waits for open sockets (they take their tokens offline on the
+// way out), but only until ctx is done.
+func TestCloseWaitsForSockets(t *testing.T) {
+    h := openHandler(t, nil)
+    defer h.store.Close()
+    h.countSocket()
+    closed := make(chan bool)
+    go func() {
+        h.Close(context.Background())
+        close(closed)
+    }()
+    select {
+    case <-closed:
+        t.Fatal("Close didn't wait for the socket")
+    case <-time.After(50 * time.Millisecond):
+    }
+    h.sockets.Done()
+    select {
+    case <-closed:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Close still waiting after the socket closed")
+    }
+
+    h = openHandler(t, nil)
+    defer h.store.Close()
+    h.countSocket()
+    defer h.sockets.Done()
+    ctx, cancel := context.WithTimeout(context.Background(),
+        20 * time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    h.Close(ctx)
+    if took := time.Since(start); took > 5 * time.Second {
+        t.Errorf("Close took %v past its deadline", took)
+    }
+}
+
+// Drain ends long polls and streams, which would otherwise hold up
+// the server's shutdown.
+func TestDrain(t *testing.T) {
+    h := testHandler(t, util.JsMap{"poll.max_wait": "60s"})
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{}`, &ping)
+    _, first := longPoll(t, h, ping.Token, "", 0)
+
+    server := httptest.NewServer(http.HandlerFunc(h.StreamHandler))
+    defer server.Close()
+    resp, err := http.Get(server.URL + "/1/stream/?tokens=" + ping.Token)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    polled := make(chan bool)
+    go func() {
+        longPoll(t, h, ping.Token, first.Version, 60)
+        close(polled)
+    }()
+
+    h.Drain()
+    select {
+    case <-polled:
+    case <-time.After(5 * time.Second):
+        t.Error("long poll still waiting after Drain")
+    }
+    if _, err := ioutil.ReadAll(resp.Body); err != nil {
+        t.Errorf("stream: %v", err)
+    }
+}
@@ -0,0 +1,303 @@
+package moztradamus
+
+// The /1/ API: JSON in, JSON out, JSON errors.
+
+import(
+    "mozilla.org/util"
+
+    "encoding/json"
+    "net/http"
+    "io"
+    "time"
+)
+
+// Most we'll read of a /1/ request body that's about one token (ping,
+// offline, revoke, rotate). Ones with token lists are held to
+// poll.max_body.
+const maxTokenBody = 4096
+
+type pollOptions struct {
+    // Only report tokens that pinged within this many seconds (0 for
+    // any live token).
+    MaxAge int64 `json:"max_age"`
+    // Long poll: hold the reply up to Wait seconds, until it would be
+    // different from version Since.
+    Wait  int64  `json:"wait"`
+    Since string `json:"since"`
+}
+
+type pollRequest struct {
+    Tokens  []string          `json:"tokens"`
+    // poll a roster's members instead.
+    Roster  string            `json:"roster"`
+    // to see private tokens: a grantee's token and key, and/or grants
+    // by the token they're for.
+    As      *tokenRequest     `json:"as"`
+    Grants  map[string]string `json:"grants"`
+    Options pollOptions       `json:"options"`
+}
+
+type pollResult struct {
+    Token     string `json:"token"`
+    Found     bool   `json:"found"`
+    State     string `json:"state"`
+    Age       *int64 `json:"age_seconds"`
+    // in place of age_seconds, if it's being kept vague.
+    Freshness string `json:"freshness,omitempty"`
+    Status    string `json:"status,omitempty"`
+    Message   string `json:"message,omitempty"`
+    MovedTo   string `json:"moved_to,omitempty"`
+}
+
+type pollResponse struct {
+    Results []pollResult `json:"results"`
+    Version string       `json:"version"`
+}
+
+type pingResponse struct {
+    Token  string `json:"token"`
+    Key    string `json:"key"`
+    TTL    int64  `json:"ttl"`
+    Status string `json:"status"`
+}
+
+// Just a token and its write key, for /1/offline/, /1/revoke/ and
+// /1/rotate/.
+type tokenRequest struct {
+    Token string `json:"token"`
+    Key   string `json:"key"`
+}
+
+type tokenResponse struct {
+    Token string `json:"token"`
+    State string `json:"state"`
+}
+
+type rotateResponse struct {
+    Token    string `json:"token"`
+    Key      string `json:"key"`
+    Replaces string `json:"replaces"`
+}
+
+type errorResponse struct {
+    Status int    `json:"status"`
+    Error  string `json:"error"`
+}
+
+func (self *Handler) jsonReply(resp http.ResponseWriter, reply interface{}, status int) {
+    body, err := json.Marshal(reply)
+    if err != nil {
+        self.logger.Error("handler", "Could not encode reply",
+            util.Fields{"error": err.Error()})
+        body = []byte(`{"status":500,"error":"Could not encode reply"}`)
+        status = http.StatusInternalServerError
+    }
+    resp.Header().Set("Content-Type", "application/json")
+    resp.WriteHeader(status)
+    resp.Write(body)
+    resp.Write([]byte("\n"))
+}
+
+func (self *Handler) jsonErr(resp http.ResponseWriter, msg string, status int) {
+    if status == 0 {
+        status = 500
+    }
+    if len(msg) == 0 {
+        msg = http.StatusText(status)
+    }
+    self.jsonReply(resp, errorResponse{Status: status, Error: msg}, status)
+}
+
+// Read a JSON request body (of at most maxTokenBody) into reply.
+// Returns false (having already sent the error) if that didn't work.
+func (self *Handler) readJSON(resp http.ResponseWriter, req *http.Request, reply interface{}) bool {
+    return self.readJSONUpTo(resp, req, reply, maxTokenBody)
+}
+
+// readJSON, for a body of at most limit bytes. Longer gets a 413.
+func (self *Handler) readJSONUpTo(resp http.ResponseWriter, req *http.Request, reply interface{}, limit int64) bool {
+    if req.Method != "POST" {
+        self.jsonErr(resp, "", http.StatusMethodNotAllowed)
+        return false
+    }
+    if req.ContentLength > limit {
+        self.jsonErr(resp, "Request body too large",
+            http.StatusRequestEntityTooLarge)
+        return false
+    }
+    // one byte over, as for /0/poll/, to tell a cut off body from a
+    // bad one.
+    body := &io.LimitedReader{R: req.Body, N: limit + 1}
+    err := json.NewDecoder(body).Decode(reply)
+    if err != nil && body.N == 0 {
+        self.jsonErr(resp, "Request body too large",
+            http.StatusRequestEntityTooLarge)
+        return false
+    }
+    if err != nil {
+        self.jsonErr(resp, "Invalid JSON body: " + err.Error(),
+            http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+// POST /1/ping/ {"token":..., "key":..., "ttl":..., "class":...,
+// "status":..., "message":...}. No token gets you a new one (and its
+// key), otherwise the key has to match.
+func (self *Handler) V1PingHandler(resp http.ResponseWriter, req *http.Request) {
+    var ping pingRequest
+
+    if !self.allowRequest(resp, req, self.jsonErr) {
+        return
+    }
+    if !self.readJSON(resp, req, &ping) {
+        return
+    }
+    if !self.allowPing(resp, ping.Token, ping.Key, self.jsonErr) {
+        return
+    }
+    presence, err := self.register(&ping)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    self.jsonReply(resp, pingResponse{Token: ping.Token,
+        Key: ping.Key,
+        TTL: int64(presence.TTL / time.Second),
+        Status: presence.Status}, http.StatusOK)
+}
+
+// POST /1/poll/ {"tokens":[...], "options":{...}}, or {"roster":...}
+// in place of the tokens. Every token asked about gets a result, found
+// or not.
+func (self *Handler) V1PollHandler(resp http.ResponseWriter, req *http.Request) {
+    var poll pollRequest
+
+    if !self.allowRequest(resp, req, self.jsonErr) {
+        return
+    }
+    if !self.readJSONUpTo(resp, req, &poll, self.poll.maxBody) {
+        return
+    }
+    if poll.Options.MaxAge < 0 {
+        self.jsonErr(resp, "Invalid max_age", http.StatusBadRequest)
+        return
+    }
+
+    wait, err := self.pollWait(poll.Options.Wait)
+    if err != nil {
+        self.jsonErr(resp, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // (a roster's size is held to roster.max_size.)
+    if len(poll.Tokens) > self.poll.maxTokens {
+        self.jsonErr(resp, "Too many tokens", http.StatusRequestEntityTooLarge)
+        return
+    }
+
+    if len(poll.Roster) > 0 {
+        if len(poll.Tokens) > 0 {
+            self.jsonErr(resp, "Give tokens or a roster, not both",
+                http.StatusBadRequest)
+            return
+        }
+        if poll.Tokens, err = self.rosterTokens(poll.Roster); err != nil {
+            aerr := err.(apiError)
+            self.jsonErr(resp, aerr.msg, aerr.status)
+            return
+        }
+    }
+    v, err := self.viewerFor(poll.As, poll.Grants)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    results := make([]pollResult, len(poll.Tokens))
+    tokens, err := canonicalTokens(poll.Tokens)
+    if err != nil {
+        self.jsonErr(resp, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !self.allowPoll(resp, req, len(tokens), self.jsonErr) {
+        return
+    }
+    states, presences, movedTo, version := self.lookupChanged(req, tokens, v,
+        poll.Options.Since, wait)
+    now := time.Now().UTC().Unix()
+    for i, token := range poll.Tokens {
+        results[i].Token = token
+        results[i].MovedTo = movedTo[i]
+        state, presence := states[i], presences[i]
+        results[i].State = state
+        if presence == nil {
+            continue
+        }
+        var limit int64
+        results[i].Age, results[i].Freshness, limit = self.freshness(
+            ownerOf(tokens[i], movedTo[i]), presence, now)
+        if state != statePresent || (poll.Options.MaxAge > 0 &&
+            (limit < 0 || limit > poll.Options.MaxAge)) {
+            continue
+        }
+        results[i].Found = true
+        results[i].Status = presence.Status
+        results[i].Message = presence.Message
+    }
+    self.jsonReply(resp, pollResponse{Results: results, Version: version},
+        http.StatusOK)
+}
+
+func (self *Handler) v1Retire(resp http.ResponseWriter, req *http.Request, revoke bool) {
+    var tr tokenRequest
+
+    if !self.readJSON(resp, req, &tr) {
+        return
+    }
+    token, err := self.retire(tr.Token, tr.Key, revoke)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    state := stateOffline
+    if revoke {
+        state = stateRevoked
+    }
+    self.jsonReply(resp, tokenResponse{Token: token, State: state},
+        http.StatusOK)
+}
+
+// POST /1/offline/ {"token":..., "key":...}. Polls report the token as
+// offline until it pings again.
+func (self *Handler) V1OfflineHandler(resp http.ResponseWriter, req *http.Request) {
+    self.v1Retire(resp, req, false)
+}
+
+// POST /1/revoke/ {"token":..., "key":...}. Retires the token for good.
+func (self *Handler) V1RevokeHandler(resp http.ResponseWriter, req *http.Request) {
+    self.v1Retire(resp, req, true)
+}
+
+// POST /1/rotate/ {"token":..., "key":...}. Returns the new token and
+// its key; polls for the old one report on the new one for a while.
+func (self *Handler) V1RotateHandler(resp http.ResponseWriter, req *http.Request) {
+    var tr tokenRequest
+
+    if !self.readJSON(resp, req, &tr) {
+        return
+    }
+    token, key, err := self.rotate(tr.Token, tr.Key)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    old, _ := canonicalToken(tr.Token)
+    self.jsonReply(resp, rotateResponse{Token: token,
+        Key: key,
+        Replaces: old}, http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package moztradamus
+
+// Long polling: /poll/ that waits for something to change.
+
+/** Every poll reply comes with a version (the X-Poll-Version header for
+ * /0/, "version" for /1/), a hash of what the reply says about each
+ * token, apart from ages. A poll that passes that back as "since",
+ * along with a "wait" in seconds, is held until the answer would be
+ * different (a token comes or goes, changes status, and so on) or the
+ * wait runs out, whichever is first. Either way it gets the current
+ * answer. Waits are capped at "poll.max_wait".
+ */
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "fmt"
+    "hash/fnv"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+func parseMaxWait(config util.JsMap, logger *util.HekaLogger) time.Duration {
+    d, err := time.ParseDuration(util.MzGet(config, "poll.max_wait", "60s"))
+    if err != nil || d < 0 {
+        logger.Error("poll", "Invalid poll.max_wait, using 60s", nil)
+        return 60 * time.Second
+    }
+    return d
+}
+
+// Parse a wait (in seconds), and keep it within poll.max_wait.
+func (self *Handler) pollWait(wait int64) (time.Duration, error) {
+    if wait < 0 {
+        return 0, apiError{"Invalid wait", http.StatusBadRequest}
+    }
+    d := time.Duration(wait) * time.Second
+    if d > self.maxWait {
+        d = self.maxWait
+    }
+    return d, nil
+}
+
+// Hash what a poll would say about the tokens, bar ages.
+func pollVersion(tokens, states []string, presences []*storage.Presence, movedTo []string) string {
+    h := fnv.New64a()
+    for i, token := range tokens {
+        fmt.Fprintf(h, "%s\x00%s\x00%s\x00", token, states[i], movedTo[i])
+        if states[i] == statePresent {
+            fmt.Fprintf(h, "%s\x00%s\x00", presences[i].Status,
+                presences[i].Message)
+        }
+    }
+    return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// Tell the broker about present tokens we looked up, so it can say
+// when they expire.
+func (self *Handler) seed(pks [][]byte, states []string, presences []*storage.Presence, movedTo []string) {
+    for i, pk := range pks {
+        if states[i] == statePresent && len(movedTo[i]) == 0 {
+            self.broker.Seed(pk, presences[i])
+        }
+    }
+}
+
+// lookup, but if the answer's version is still since, wait up to wait
+// for it to change.
+func (self *Handler) lookupChanged(req *http.Request, tokens []string, v *viewer, since string, wait time.Duration) (states []string, presences []*storage.Presence, movedTo []string, version string) {
+    if len(since) == 0 || wait <= 0 {
+        states, presences, movedTo = self.lookup(tokens, v)
+        return states, presences, movedTo,
+            pollVersion(tokens, states, presences, movedTo)
+    }
+
+    pks := make([][]byte, len(tokens))
+    for i, token := range tokens {
+        pks[i] = []byte(token)
+    }
+    // Subscribe before looking, so nothing falls in between.
+    sub := self.broker.Subscribe(pks)
+    defer sub.Close()
+    timeout := time.NewTimer(wait)
+    defer timeout.Stop()
+    for {
+        states, presences, movedTo = self.lookup(tokens, v)
+        version = pollVersion(tokens, states, presences, movedTo)
+        if version != since {
+            return states, presences, movedTo, version
+        }
+        self.seed(pks, states, presences, movedTo)
+        // A ping that changes nothing isn't worth looking again for.
+        for changed := false; !changed; {
+            select {
+            case ev, ok := <-sub.C:
+                if !ok {
+                    // fell behind; this is as current as it gets.
+                    return states, presences, movedTo, version
+                }
+                changed = ev.Kind != storage.EventPing
+            case <-timeout.C:
+                return states, presences, movedTo, version
+            case <-req.Context().Done():
+                return states, presences, movedTo, version
+            case <-self.closing:
+                return states, presences, movedTo, version
+            }
+        }
+    }
+}
@@ -0,0 +1,77 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func longPoll(t *testing.T, h *Handler, token, since string, wait int) (int, pollResponse) {
+    var poll pollResponse
+    code := call(t, h.V1PollHandler, `{"tokens":["` + token +
+        `"],"options":{"since":"` + since + `","wait":` +
+        strconv.Itoa(wait) + `}}`, &poll)
+    return code, poll
+}
+
+func TestLongPoll(t *testing.T) {
+    h := testHandler(t, util.JsMap{"poll.max_wait": "200ms"})
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{"status":"away"}`, &ping)
+
+    _, first := longPoll(t, h, ping.Token, "", 0)
+    if len(first.Version) == 0 {
+        t.Fatalf("no version: %+v", first)
+    }
+    // an old version gets an answer straight away.
+    start := time.Now()
+    if _, poll := longPoll(t, h, ping.Token, "old", 30); poll.Version != first.Version {
+        t.Errorf("old version: got %q, want %q", poll.Version, first.Version)
+    }
+    // nothing changes, so it waits out poll.max_wait (not the 30s asked
+    // for), and says the same again.
+    if _, poll := longPoll(t, h, ping.Token, first.Version, 30); poll.Version != first.Version {
+        t.Errorf("no change: got %q, want %q", poll.Version, first.Version)
+    }
+    if took := time.Since(start); took < 200 * time.Millisecond ||
+        took > 5 * time.Second {
+        t.Errorf("no change: took %v", took)
+    }
+    if code, _ := longPoll(t, h, ping.Token, first.Version, -1); code != http.StatusBadRequest {
+        t.Errorf("negative wait: got %d, want 400", code)
+    }
+}
+
+func TestLongPollWakes(t *testing.T) {
+    h := testHandler(t, util.JsMap{"poll.max_wait": "30s"})
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{"status":"away"}`, &ping)
+    _, first := longPoll(t, h, ping.Token, "", 0)
+
+    done := make(chan pollResponse)
+    go func() {
+        _, poll := longPoll(t, h, ping.Token, first.Version, 30)
+        done <- poll
+    }()
+    // a ping that changes nothing doesn't wake it.
+    auth := `{"token":"` + ping.Token + `","key":"` + ping.Key + `"`
+    call(t, h.V1PingHandler, auth + `,"status":"away"}`, nil)
+    select {
+    case poll := <-done:
+        t.Fatalf("woke for nothing: %+v", poll)
+    case <-time.After(100 * time.Millisecond):
+    }
+    call(t, h.V1PingHandler, auth + `,"status":"busy"}`, nil)
+    select {
+    case poll := <-done:
+        if poll.Version == first.Version || len(poll.Results) != 1 ||
+            poll.Results[0].Status != "busy" {
+            t.Errorf("got %+v", poll)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("still waiting after the status changed")
+    }
+}
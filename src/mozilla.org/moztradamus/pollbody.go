@@ -0,0 +1,97 @@
+package moztradamus
+
+// Reading the token list for /0/poll/.
+
+/** The body is read a token at a time, so a request takes about as much
+ * memory as the tokens in it. Over "poll.max_body" bytes or
+ * "poll.max_tokens" tokens gets a 413. /1/poll/ is held to both
+ * too.
+ */
+
+import(
+    "mozilla.org/util"
+
+    "bufio"
+    "bytes"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// Longest single item in a list; tokens are well under this.
+const maxItemLen = 1024
+
+type pollLimits struct {
+    maxTokens int
+    maxBody   int64
+}
+
+func newPollLimits(config util.JsMap, logger *util.HekaLogger) pollLimits {
+    pl := pollLimits{maxTokens: 10000, maxBody: 1048576}
+    if n, err := strconv.ParseInt(util.MzGet(config, "poll.max_tokens",
+        "10000"), 0, 0); err == nil && n > 0 {
+        pl.maxTokens = int(n)
+    } else {
+        logger.Error("poll", "Invalid poll.max_tokens, using 10000", nil)
+    }
+    if n, err := strconv.ParseInt(util.MzGet(config, "poll.max_body",
+        "1048576"), 0, 64); err == nil && n > 0 {
+        pl.maxBody = n
+    } else {
+        logger.Error("poll", "Invalid poll.max_body, using 1048576", nil)
+    }
+    return pl
+}
+
+// A bufio.SplitFunc for comma separated lists.
+func scanCommas(data []byte, atEOF bool) (advance int, token []byte, err error) {
+    if i := bytes.IndexByte(data, ','); i >= 0 {
+        return i + 1, data[:i], nil
+    }
+    if atEOF && len(data) > 0 {
+        return len(data), data, nil
+    }
+    // ask for more.
+    return 0, nil, nil
+}
+
+// Read the comma separated tokens in a /0/poll/ body.
+func (self *Handler) readPollBody(req *http.Request) ([]string, error) {
+    tooBig := apiError{"Request body too large",
+        http.StatusRequestEntityTooLarge}
+    if req.ContentLength > self.poll.maxBody {
+        return nil, tooBig
+    }
+    // one byte over, to tell a body that's exactly the limit from a
+    // longer one.
+    body := &io.LimitedReader{R: req.Body, N: self.poll.maxBody + 1}
+    scanner := bufio.NewScanner(body)
+    scanner.Buffer(make([]byte, 0, 512), maxItemLen)
+    scanner.Split(scanCommas)
+
+    var items []string
+    for scanner.Scan() {
+        item := strings.TrimSpace(scanner.Text())
+        if len(item) == 0 {
+            continue
+        }
+        if len(items) == self.poll.maxTokens {
+            return nil, apiError{"Too many tokens",
+                http.StatusRequestEntityTooLarge}
+        }
+        self.logger.Info("poll", item, nil)
+        items = append(items, item)
+    }
+    if body.N == 0 {
+        return nil, tooBig
+    }
+    switch err := scanner.Err(); err {
+    case nil:
+    case bufio.ErrTooLong:
+        return nil, apiError{"Malformed token", http.StatusBadRequest}
+    default:
+        return nil, apiError{"Could not read body", http.StatusBadRequest}
+    }
+    return items, nil
+}
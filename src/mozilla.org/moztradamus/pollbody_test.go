@@ -0,0 +1,69 @@
+package moztradamus
+
+import(
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestReadPollBody(t *testing.T) {
+    self := &Handler{poll: pollLimits{maxTokens: 3, maxBody: 32},
+        logger: testLogger()}
+    tests := []struct {
+        name    string
+        body    string
+        // don't say how long the body is up front.
+        chunked bool
+        items   []string
+        status  int
+    }{
+        {"one", "abc", false, []string{"abc"}, 0},
+        {"list", "a,b,c", false, []string{"a", "b", "c"}, 0},
+        {"spaces and blanks", " a ,,\nb, ", false, []string{"a", "b"}, 0},
+        {"trailing comma", "a,b,", false, []string{"a", "b"}, 0},
+        {"empty", "", false, nil, 0},
+        {"at the limit", strings.Repeat("x", 32), false,
+            []string{strings.Repeat("x", 32)}, 0},
+        {"too many tokens", "a,b,c,d", false, nil,
+            http.StatusRequestEntityTooLarge},
+        {"too long", strings.Repeat("x", 33), false, nil,
+            http.StatusRequestEntityTooLarge},
+        {"too long, chunked", strings.Repeat("x,", 17), true, nil,
+            http.StatusRequestEntityTooLarge},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest("POST", "/0/poll/",
+            strings.NewReader(test.body))
+        if test.chunked {
+            req.ContentLength = -1
+        }
+        items, err := self.readPollBody(req)
+        if test.status != 0 {
+            if aerr, ok := err.(apiError); !ok || aerr.status != test.status {
+                t.Errorf("%s: got error %v, want a %d", test.name, err,
+                    test.status)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: got error %v", test.name, err)
+            continue
+        }
+        if !reflect.DeepEqual(items, test.items) {
+            t.Errorf("%s: got %q, want %q", test.name, items, test.items)
+        }
+    }
+}
+
+func TestReadPollBodyLongItem(t *testing.T) {
+    self := &Handler{poll: pollLimits{maxTokens: 3, maxBody: 4096},
+        logger: testLogger()}
+    req := httptest.NewRequest("POST", "/0/poll/",
+        strings.NewReader(strings.Repeat("x", maxItemLen + 1)))
+    _, err := self.readPollBody(req)
+    if aerr, ok := err.(apiError); !ok || aerr.status != http.StatusBadRequest {
+        t.Errorf("got error %v, want a 400", err)
+    }
+}
@@ -0,0 +1,117 @@
+package moztradamus
+
+// Coarser ages, so polls don't give away exactly when someone pinged.
+
+/** An exact age is enough to work out when someone wakes up, commutes
+ * and so on. "privacy.mode" sets how ages are shown:
+ *
+ *  exact  - to the second (the default).
+ *  jitter - made older by up to "privacy.jitter" (default 5m). The
+ *           amount is fixed for any one ping, so polling over and over
+ *           doesn't average it out.
+ *  bucket - no age at all, just "freshness": "now" (under a minute),
+ *           "<5m", "<15m" or "away".
+ *
+ * Token owners can ask for a precision of their own when they ping
+ * (same values); whichever of that and the server's mode is coarser
+ * wins. A max_age on /1/poll/ is checked against the age as shown (for
+ * buckets, the top of the bucket).
+ */
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "encoding/binary"
+    "strconv"
+    "time"
+)
+
+// Freshness buckets, and the age each one goes up to.
+var freshnessBuckets = []struct {
+    name  string
+    under int64
+}{
+    {"now", 60},
+    {"<5m", 5 * 60},
+    {"<15m", 15 * 60},
+}
+
+// Freshness past the last bucket.
+const freshnessAway = "away"
+
+// How coarse each precision is.
+var precisionRank = map[string]int{
+    "": 0,
+    storage.PrecisionExact: 0,
+    storage.PrecisionJitter: 1,
+    storage.PrecisionBucket: 2,
+}
+
+type privacyConfig struct {
+    mode   string
+    jitter int64
+}
+
+func newPrivacyConfig(config util.JsMap, logger *util.HekaLogger) privacyConfig {
+    pc := privacyConfig{mode: storage.PrecisionExact, jitter: 5 * 60}
+    if mode := util.MzGet(config, "privacy.mode",
+        storage.PrecisionExact); storage.ValidPrecision(mode) {
+        pc.mode = mode
+    } else {
+        logger.Error("privacy", "Invalid privacy.mode, using exact", nil)
+    }
+    if d, err := time.ParseDuration(util.MzGet(config, "privacy.jitter",
+        "5m")); err == nil && d > 0 {
+        pc.jitter = int64(d / time.Second)
+    } else {
+        logger.Error("privacy", "Invalid privacy.jitter, using 5m", nil)
+    }
+    return pc
+}
+
+// The coarser of the server's mode and the owner's precision.
+func (self privacyConfig) coarsest(precision string) string {
+    if precisionRank[precision] > precisionRank[self.mode] {
+        return precision
+    }
+    return self.mode
+}
+
+// How fresh to say a presence is: an age in seconds, or (for bucket
+// precision) a nil age and the bucket's name. limit is what to check a
+// max_age against: the age shown, the top of the bucket, or -1 for
+// "away".
+func (self *Handler) freshness(token string, p *storage.Presence, now int64) (age *int64, bucket string, limit int64) {
+    secs := now - p.Last
+    switch self.privacy.coarsest(p.Precision) {
+    case storage.PrecisionBucket:
+        for _, b := range freshnessBuckets {
+            if secs < b.under {
+                return nil, b.name, b.under
+            }
+        }
+        // no upper bound.
+        return nil, freshnessAway, -1
+    case storage.PrecisionJitter:
+        secs += self.jitter(token, p.Last)
+    }
+    return &secs, "", secs
+}
+
+// The token a presence really belongs to, once rotations are followed.
+// Jitter has to be worked out from this (in its current form), or
+// asking about the same ping another way would get a fresh sample.
+func ownerOf(token, movedTo string) string {
+    if len(movedTo) > 0 {
+        return movedTo
+    }
+    return token
+}
+
+// A made up extra age for the ping at last, the same every time.
+func (self *Handler) jitter(token string, last int64) int64 {
+    sum := self.keys.sign(self.keys.current, []byte("jitter:"),
+        []byte(token), []byte(strconv.FormatInt(last, 10)))
+    return int64(binary.BigEndian.Uint64(sum) % uint64(self.privacy.jitter + 1))
+}
@@ -0,0 +1,68 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "testing"
+)
+
+func TestFreshnessBuckets(t *testing.T) {
+    h := testHandler(t, util.JsMap{"privacy.mode": "bucket"})
+    now := int64(1400000000)
+    tests := []struct {
+        secs   int64
+        bucket string
+        limit  int64
+    }{
+        {0, "now", 60},
+        {59, "now", 60},
+        {60, "<5m", 300},
+        {899, "<15m", 900},
+        {900, freshnessAway, -1},
+    }
+    for _, test := range tests {
+        age, bucket, limit := h.freshness("t",
+            &storage.Presence{Last: now - test.secs}, now)
+        if age != nil || bucket != test.bucket || limit != test.limit {
+            t.Errorf("%ds: got (%v, %q, %d), want (nil, %q, %d)", test.secs,
+                age, bucket, limit, test.bucket, test.limit)
+        }
+    }
+}
+
+func TestFreshnessPrecision(t *testing.T) {
+    now := int64(1400000000)
+    p := &storage.Presence{Last: now - 30}
+
+    exact := testHandler(t, nil)
+    if age, bucket, _ := exact.freshness("t", p, now); age == nil ||
+        *age != 30 || bucket != "" {
+        t.Errorf("exact: got (%v, %q)", age, bucket)
+    }
+
+    jitter := testHandler(t, util.JsMap{"privacy.mode": "jitter",
+        "privacy.jitter": "10m"})
+    age, _, limit := jitter.freshness("t", p, now)
+    if age == nil || *age < 30 || *age > 30 + 600 || limit != *age {
+        t.Fatalf("jitter: got %v, limit %d", age, limit)
+    }
+    // the same ping always gets the same jitter, however often it's
+    // asked about.
+    again, _, _ := jitter.freshness("t", p, now)
+    if *again != *age {
+        t.Errorf("jitter moved: %d then %d", *age, *again)
+    }
+
+    // the owner can ask for coarser than the server, not finer.
+    p.Precision = storage.PrecisionBucket
+    if age, bucket, _ := jitter.freshness("t", p, now); age != nil ||
+        bucket != "now" {
+        t.Errorf("owner's bucket: got (%v, %q)", age, bucket)
+    }
+    p.Precision = storage.PrecisionExact
+    if age, _, _ := jitter.freshness("t", p, now); age == nil ||
+        *age != *again {
+        t.Errorf("owner's exact: got %v, want the jittered %d", age, *again)
+    }
+}
@@ -0,0 +1,299 @@
+package moztradamus
+
+// Rate limits for /ping/, /poll/ and the streams.
+
+/** Token buckets: each key gets "burst" credits, which come back at
+ * "rate" a second. Three sets of them:
+ *
+ *  ratelimit.ip    - ping and poll requests, per client address. Opening
+ *                    a stream or socket, and each socket subscribe,
+ *                    count too.
+ *  ratelimit.poll  - tokens polled, per client address. One huge poll
+ *                    may go through on a full bucket, but then has to be
+ *                    paid off before the next. Tokens streamed or
+ *                    subscribed to count the same.
+ *  ratelimit.token - pings, per token. Only pings with the right write
+ *                    key count, so nobody can use up someone else's.
+ *
+ * Each has a ".rate" and a ".burst"; a rate of 0 turns it off. Going
+ * over gets a 429, with a Retry-After. Behind a proxy, set
+ * "ratelimit.trust_forwarded" to go by the address it puts last in
+ * X-Forwarded-For rather than the proxy's own.
+ *
+ * "ratelimit.streams" caps how many streams and sockets one address may
+ * have open at once (default 10, 0 for no cap); the next gets a 429.
+ *
+ * Counters are in memory, so each node keeps its own. A SIGHUP picks
+ * up new limits.
+ */
+
+import(
+    "mozilla.org/util"
+
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type tokenBucket struct {
+    credit float64
+    last   time.Time
+}
+
+// A token bucket per key.
+type rateLimit struct {
+    sync.Mutex
+    rate    float64
+    burst   float64
+    buckets map[string]*tokenBucket
+}
+
+func newRateLimit() *rateLimit {
+    return &rateLimit{buckets: make(map[string]*tokenBucket)}
+}
+
+// Read name.rate and name.burst. The buckets are kept, so a reload
+// doesn't hand out a fresh burst.
+func (self *rateLimit) configure(config util.JsMap, name, rate, burst string, logger *util.HekaLogger) {
+    r, err := strconv.ParseFloat(util.MzGet(config, name + ".rate", rate), 64)
+    if err != nil || r < 0 {
+        logger.Error("ratelimit", "Invalid " + name + ".rate, using " + rate,
+            nil)
+        r, _ = strconv.ParseFloat(rate, 64)
+    }
+    b, err := strconv.ParseFloat(util.MzGet(config, name + ".burst", burst), 64)
+    if err != nil || b < 1 {
+        logger.Error("ratelimit", "Invalid " + name + ".burst, using " + burst,
+            nil)
+        b, _ = strconv.ParseFloat(burst, 64)
+    }
+    self.Lock()
+    defer self.Unlock()
+    self.rate, self.burst = r, b
+}
+
+// Take cost credits from key's bucket. If it can't be had yet, nothing is
+// taken and the wait is returned. A cost over the burst needs a full
+// bucket, and leaves it in debt.
+func (self *rateLimit) take(key string, cost float64) (time.Duration, bool) {
+    now := time.Now()
+
+    self.Lock()
+    defer self.Unlock()
+    // a rate of 0 is no limit.
+    if self.rate == 0 {
+        return 0, true
+    }
+    b, ok := self.buckets[key]
+    if !ok {
+        b = &tokenBucket{credit: self.burst, last: now}
+        self.buckets[key] = b
+    }
+    b.credit = math.Min(self.burst,
+        b.credit + now.Sub(b.last).Seconds() * self.rate)
+    b.last = now
+    need := math.Min(cost, self.burst)
+    if b.credit < need {
+        return time.Duration((need - b.credit) / self.rate *
+            float64(time.Second)), false
+    }
+    b.credit -= cost
+    return 0, true
+}
+
+// Forget buckets that have filled back up; they're as good as new.
+func (self *rateLimit) sweep() {
+    now := time.Now()
+    self.Lock()
+    defer self.Unlock()
+    for key, b := range self.buckets {
+        if self.rate == 0 || b.credit + now.Sub(b.last).Seconds() * self.rate >= self.burst {
+            delete(self.buckets, key)
+        }
+    }
+}
+
+// Counts what's open per key, up to max.
+type openLimit struct {
+    sync.Mutex
+    max  int
+    open map[string]int
+}
+
+func newOpenLimit() *openLimit {
+    return &openLimit{open: make(map[string]int)}
+}
+
+// Count one more open for key, unless it's at the max.
+func (self *openLimit) acquire(key string) bool {
+    self.Lock()
+    defer self.Unlock()
+    if self.max > 0 && self.open[key] >= self.max {
+        return false
+    }
+    self.open[key]++
+    return true
+}
+
+func (self *openLimit) release(key string) {
+    self.Lock()
+    defer self.Unlock()
+    if self.open[key]--; self.open[key] <= 0 {
+        delete(self.open, key)
+    }
+}
+
+type rateLimits struct {
+    ip             *rateLimit
+    poll           *rateLimit
+    token          *rateLimit
+    streams        *openLimit
+    forwardLock    sync.RWMutex
+    trustForwarded bool
+    done           chan bool
+}
+
+func newRateLimits(config util.JsMap, logger *util.HekaLogger) *rateLimits {
+    self := &rateLimits{
+        ip: newRateLimit(),
+        poll: newRateLimit(),
+        token: newRateLimit(),
+        streams: newOpenLimit(),
+        done: make(chan bool)}
+    self.configure(config, logger)
+    go self.sweeper(time.Minute)
+    return self
+}
+
+// (Again on SIGHUP.)
+func (self *rateLimits) configure(config util.JsMap, logger *util.HekaLogger) {
+    self.ip.configure(config, "ratelimit.ip", "20", "100", logger)
+    self.poll.configure(config, "ratelimit.poll", "2000", "20000", logger)
+    self.token.configure(config, "ratelimit.token", "1", "10", logger)
+    streams, err := strconv.Atoi(util.MzGet(config, "ratelimit.streams",
+        "10"))
+    if err != nil || streams < 0 {
+        logger.Error("ratelimit", "Invalid ratelimit.streams, using 10", nil)
+        streams = 10
+    }
+    self.streams.Lock()
+    self.streams.max = streams
+    self.streams.Unlock()
+    trust, _ := strconv.ParseBool(util.MzGet(config,
+        "ratelimit.trust_forwarded", "false"))
+    self.forwardLock.Lock()
+    self.trustForwarded = trust
+    self.forwardLock.Unlock()
+}
+
+func (self *rateLimits) sweeper(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-self.done:
+            return
+        case <-ticker.C:
+            for _, limit := range []*rateLimit{self.ip, self.poll, self.token} {
+                limit.sweep()
+            }
+        }
+    }
+}
+
+func (self *rateLimits) Close() {
+    close(self.done)
+}
+
+// Who's asking, for the per address limits.
+func (self *rateLimits) clientAddr(req *http.Request) string {
+    self.forwardLock.RLock()
+    trust := self.trustForwarded
+    self.forwardLock.RUnlock()
+    if trust {
+        if fwd := req.Header.Get("X-Forwarded-For"); len(fwd) > 0 {
+            hops := strings.Split(fwd, ",")
+            return strings.TrimSpace(hops[len(hops) - 1])
+        }
+    }
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+    return host
+}
+
+// Send a 429 (via fail, so it's in the caller's format).
+func tooMany(resp http.ResponseWriter, wait time.Duration, fail func(http.ResponseWriter, string, int)) {
+    secs := int64(math.Ceil(wait.Seconds()))
+    if secs < 1 {
+        secs = 1
+    }
+    resp.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+    fail(resp, "Too many requests", http.StatusTooManyRequests)
+}
+
+// Count a ping or poll request against its address. Returns false,
+// having sent the error, if it's over.
+func (self *Handler) allowRequest(resp http.ResponseWriter, req *http.Request, fail func(http.ResponseWriter, string, int)) bool {
+    wait, ok := self.limits.ip.take(self.limits.clientAddr(req), 1)
+    if !ok {
+        tooMany(resp, wait, fail)
+    }
+    return ok
+}
+
+// Count polled tokens against the address.
+func (self *Handler) allowPoll(resp http.ResponseWriter, req *http.Request, count int, fail func(http.ResponseWriter, string, int)) bool {
+    wait, ok := self.limits.poll.take(self.limits.clientAddr(req),
+        float64(count))
+    if !ok {
+        tooMany(resp, wait, fail)
+    }
+    return ok
+}
+
+// Count a stream or socket against its address, until it's released with
+// limits.streams.release(addr). Returns false, having sent the error, if
+// the address has too many open.
+func (self *Handler) openStream(resp http.ResponseWriter, req *http.Request, fail func(http.ResponseWriter, string, int)) (string, bool) {
+    addr := self.limits.clientAddr(req)
+    if !self.limits.streams.acquire(addr) {
+        // (no telling when one will close.)
+        tooMany(resp, time.Minute, fail)
+        return addr, false
+    }
+    return addr, true
+}
+
+// allowRequest and allowPoll together, for a socket subscribe to count
+// count tokens from addr.
+func (self *Handler) takeWatch(addr string, count int) (time.Duration, bool) {
+    if wait, ok := self.limits.ip.take(addr, 1); !ok {
+        return wait, false
+    }
+    return self.limits.poll.take(addr, float64(count))
+}
+
+// Count a ping against its token, if the key is right (if it isn't, the
+// ping is going to fail anyway).
+func (self *Handler) allowPing(resp http.ResponseWriter, token, key string, fail func(http.ResponseWriter, string, int)) bool {
+    wait, ok := self.takePing(token, key)
+    if !ok {
+        tooMany(resp, wait, fail)
+    }
+    return ok
+}
+
+// allowPing, for pings that don't come over HTTP (see socket.go).
+func (self *Handler) takePing(token, key string) (time.Duration, bool) {
+    if len(token) == 0 || !self.keys.check(token, key) {
+        return 0, true
+    }
+    canon, _ := canonicalToken(token)
+    return self.limits.token.take(canon, 1)
+}
@@ -0,0 +1,152 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTokenBucket(t *testing.T) {
+    limit := newRateLimit()
+    limit.rate, limit.burst = 10, 3
+    for i := 0; i < 3; i++ {
+        if _, ok := limit.take("a", 1); !ok {
+            t.Fatalf("take %d of the burst refused", i)
+        }
+    }
+    wait, ok := limit.take("a", 1)
+    if ok || wait <= 0 || wait > 100 * time.Millisecond {
+        t.Errorf("past the burst: got (%v, %v)", wait, ok)
+    }
+    // each key has a bucket of its own.
+    if _, ok := limit.take("b", 1); !ok {
+        t.Errorf("another key was refused")
+    }
+    time.Sleep(150 * time.Millisecond)
+    if _, ok := limit.take("a", 1); !ok {
+        t.Errorf("not refilled")
+    }
+
+    // a cost over the burst goes through on a full bucket, and leaves
+    // it in debt.
+    if _, ok := limit.take("c", 10); !ok {
+        t.Errorf("big cost on a full bucket refused")
+    }
+    if wait, ok := limit.take("c", 1); ok || wait < 500 * time.Millisecond {
+        t.Errorf("after a big cost: got (%v, %v)", wait, ok)
+    }
+
+    // a rate of 0 is no limit, and sweeping forgets the buckets.
+    limit.rate = 0
+    for i := 0; i < 10; i++ {
+        if _, ok := limit.take("a", 1); !ok {
+            t.Fatalf("no limit, but refused")
+        }
+    }
+    limit.sweep()
+    if len(limit.buckets) != 0 {
+        t.Errorf("after sweep: %d buckets left", len(limit.buckets))
+    }
+}
+
+// Only pings with the right key count against a token, so nobody can use
+// up someone else's.
+func TestPingRateLimit(t *testing.T) {
+    h := testHandler(t, util.JsMap{"ratelimit.token.rate": "0.001",
+        "ratelimit.token.burst": "1"})
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{}`, &ping)
+    tests := []struct {
+        key    string
+        status int
+    }{
+        {"nope", http.StatusForbidden},
+        {"nope", http.StatusForbidden},
+        {ping.Key, http.StatusOK},
+        {ping.Key, http.StatusTooManyRequests},
+    }
+    for i, test := range tests {
+        resp := httptest.NewRecorder()
+        h.V1PingHandler(resp, httptest.NewRequest("POST", "/1/ping/",
+            strings.NewReader(`{"token":"` + ping.Token + `","key":"` +
+                test.key + `"}`)))
+        if resp.Code != test.status {
+            t.Errorf("%d: got %d, want %d", i, resp.Code, test.status)
+        }
+        if resp.Code == http.StatusTooManyRequests &&
+            resp.Header().Get("Retry-After") == "" {
+            t.Errorf("%d: no Retry-After", i)
+        }
+    }
+}
+
+func TestClientAddr(t *testing.T) {
+    h := testHandler(t, nil)
+    req := httptest.NewRequest("GET", "/", nil)
+    req.RemoteAddr = "192.0.2.9:1234"
+    req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+    if addr := h.limits.clientAddr(req); addr != "192.0.2.9" {
+        t.Errorf("untrusted: got %s", addr)
+    }
+    h.Reload(util.JsMap{"ratelimit.trust_forwarded": "true"})
+    if addr := h.limits.clientAddr(req); addr != "203.0.113.7" {
+        t.Errorf("trusted: got %s", addr)
+    }
+}
+
+// Open a stream for tokens that's closed as soon as it's started.
+func openTestStream(h *Handler, tokens string) int {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    req := httptest.NewRequest("GET", "/1/stream/?tokens=" + tokens, nil)
+    resp := httptest.NewRecorder()
+    h.StreamHandler(resp, req.WithContext(ctx))
+    return resp.Code
+}
+
+func TestStreamRateLimits(t *testing.T) {
+    h := testHandler(t, util.JsMap{"ratelimit.poll.rate": "0.001",
+        "ratelimit.poll.burst": "3"})
+    a, _ := h.keys.mint()
+    b, _ := h.keys.mint()
+
+    if code := openTestStream(h, a + "," + b); code != http.StatusOK {
+        t.Fatalf("first stream: got %d", code)
+    }
+    // only one token's worth of credit is left.
+    if code := openTestStream(h, a + "," + b); code != http.StatusTooManyRequests {
+        t.Errorf("second stream: got %d, want 429", code)
+    }
+    if code := openTestStream(h, a); code != http.StatusOK {
+        t.Errorf("one token: got %d", code)
+    }
+}
+
+func TestStreamOpenLimit(t *testing.T) {
+    h := testHandler(t, util.JsMap{"ratelimit.streams": "2"})
+    token, _ := h.keys.mint()
+    // (httptest's address.)
+    addr := "192.0.2.1"
+
+    h.limits.streams.acquire(addr)
+    if code := openTestStream(h, token); code != http.StatusOK {
+        t.Fatalf("under the cap: got %d", code)
+    }
+    h.limits.streams.acquire(addr)
+    if code := openTestStream(h, token); code != http.StatusTooManyRequests {
+        t.Errorf("at the cap: got %d, want 429", code)
+    }
+    // other addresses have their own.
+    if !h.limits.streams.acquire("192.0.2.2") {
+        t.Errorf("another address was refused")
+    }
+    h.limits.streams.release(addr)
+    if code := openTestStream(h, token); code != http.StatusOK {
+        t.Errorf("after one closed: got %d", code)
+    }
+}
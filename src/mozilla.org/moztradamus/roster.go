@@ -0,0 +1,199 @@
+package moztradamus
+
+// Rosters: a list of tokens kept on the server, to poll by ID.
+
+/** Rather than send every token on every poll, a client can store them
+ * in a roster once and poll that (/0/poll/?roster=<id>, or "roster" in
+ * a /1/poll/). The roster's ID is minted like a token, so it has a write
+ * key too, which is needed to change or delete it. Anyone with the ID
+ * can poll it, much as anyone with a token can.
+ *
+ * Rosters live in the presence backend, so every node sees them. Edits
+ * are a read, change and write; two edits to the same roster at the
+ * same time on different nodes may lose one of them.
+ */
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "net/http"
+    "strconv"
+)
+
+type rosterRequest struct {
+    // leave out ID (and Key) to make a new roster.
+    ID     string   `json:"id"`
+    Key    string   `json:"key"`
+    // replaces the members, if given. Then Add and Remove are applied.
+    Tokens []string `json:"tokens"`
+    Add    []string `json:"add"`
+    Remove []string `json:"remove"`
+}
+
+type rosterResponse struct {
+    ID      string   `json:"id"`
+    Key     string   `json:"key,omitempty"`
+    Tokens  []string `json:"tokens"`
+    Deleted bool     `json:"deleted,omitempty"`
+}
+
+func parseRosterMax(config util.JsMap, logger *util.HekaLogger) int {
+    n, err := strconv.ParseInt(util.MzGet(config, "roster.max_size",
+        "10000"), 0, 0)
+    if err != nil || n < 1 {
+        logger.Error("roster", "Invalid roster.max_size, using 10000", nil)
+        return 10000
+    }
+    return int(n)
+}
+
+// The members of roster id, canonical and ready to poll.
+func (self *Handler) rosterTokens(id string) ([]string, error) {
+    canon, err := canonicalToken(id)
+    if err != nil {
+        return nil, apiError{"Malformed roster: " + id, http.StatusBadRequest}
+    }
+    members, err := self.store.GetRoster([]byte(canon))
+    if err == storage.ErrNotFound {
+        return nil, apiError{"No such roster", http.StatusNotFound}
+    }
+    if err != nil {
+        self.logger.Error("roster", "Could not fetch roster",
+            util.Fields{"roster": canon, "error": err.Error()})
+        return nil, apiError{"Could not fetch roster",
+            http.StatusServiceUnavailable}
+    }
+    tokens := make([]string, len(members))
+    for i, member := range members {
+        tokens[i] = string(member)
+    }
+    return tokens, nil
+}
+
+// Apply an edit to a roster's members, keeping them in order and
+// without repeats.
+func (self *Handler) editRoster(members []string, rr *rosterRequest) ([]string, error) {
+    if rr.Tokens != nil {
+        members = nil
+    }
+    remove, err := canonicalTokens(rr.Remove)
+    if err != nil {
+        return nil, err
+    }
+    replace, err := canonicalTokens(rr.Tokens)
+    if err != nil {
+        return nil, err
+    }
+    add, err := canonicalTokens(rr.Add)
+    if err != nil {
+        return nil, err
+    }
+    drop := make(map[string]bool, len(remove))
+    for _, token := range remove {
+        drop[token] = true
+    }
+    seen := make(map[string]bool)
+    result := []string{}
+    for _, list := range [][]string{members, replace, add} {
+        for _, token := range list {
+            if drop[token] || seen[token] {
+                continue
+            }
+            seen[token] = true
+            result = append(result, token)
+        }
+    }
+    if len(result) > self.rosterMax {
+        return nil, apiError{"Too many tokens",
+            http.StatusRequestEntityTooLarge}
+    }
+    return result, nil
+}
+
+func (self *Handler) putRoster(id string, tokens []string) error {
+    members := make([][]byte, len(tokens))
+    for i, token := range tokens {
+        members[i] = []byte(token)
+    }
+    err := self.store.PutRoster([]byte(id), members)
+    if err == storage.ErrFull {
+        return apiError{"Too many rosters", http.StatusServiceUnavailable}
+    }
+    if err != nil {
+        self.logger.Error("roster", "Could not store roster",
+            util.Fields{"roster": id, "error": err.Error()})
+        return apiError{"Could not store roster",
+            http.StatusServiceUnavailable}
+    }
+    return nil
+}
+
+// POST /1/roster/ {"tokens":[...]} makes a roster; add "id" and "key"
+// (and "add", "remove" or a new "tokens") to change one.
+// GET /1/roster/<id> lists the members. DELETE /1/roster/<id> (with the
+// key, as for DELETE /0/ping/) removes it.
+func (self *Handler) RosterHandler(resp http.ResponseWriter, req *http.Request) {
+    var rr rosterRequest
+    var err error
+
+    reply := rosterResponse{}
+    switch req.Method {
+    case "GET":
+        reply.ID = pathToken(req.URL.Path)
+        reply.Tokens, err = self.rosterTokens(reply.ID)
+    case "DELETE":
+        if reply.ID, err = self.authorize(pathToken(req.URL.Path),
+            writeKey(req)); err != nil {
+            break
+        }
+        if _, err = self.rosterTokens(reply.ID); err != nil {
+            break
+        }
+        if derr := self.store.DelRoster([]byte(reply.ID)); derr != nil {
+            self.logger.Error("roster", "Could not delete roster",
+                util.Fields{"roster": reply.ID, "error": derr.Error()})
+            err = apiError{"Could not delete roster",
+                http.StatusServiceUnavailable}
+            break
+        }
+        reply.Tokens = []string{}
+        reply.Deleted = true
+    default:
+        // minting rosters takes nothing but asking.
+        if !self.allowRequest(resp, req, self.jsonErr) {
+            return
+        }
+        if !self.readJSONUpTo(resp, req, &rr, self.poll.maxBody) {
+            return
+        }
+        var members []string
+        if len(rr.ID) == 0 {
+            if reply.ID, reply.Key, err = self.newToken(); err != nil {
+                err = apiError{"Could not create roster",
+                    http.StatusInternalServerError}
+                break
+            }
+        } else {
+            if reply.ID, err = self.authorize(rr.ID, rr.Key); err != nil {
+                break
+            }
+            // one edit at a time, at least on this node.
+            self.rosterLock.Lock()
+            defer self.rosterLock.Unlock()
+            if members, err = self.rosterTokens(reply.ID); err != nil {
+                break
+            }
+        }
+        if reply.Tokens, err = self.editRoster(members, &rr); err != nil {
+            break
+        }
+        err = self.putRoster(reply.ID, reply.Tokens)
+    }
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    self.jsonReply(resp, reply, http.StatusOK)
+}
@@ -0,0 +1,90 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+// GET or DELETE path, and decode the JSON reply into reply.
+func callPath(t *testing.T, handler http.HandlerFunc, method, path string, reply interface{}) int {
+    resp := httptest.NewRecorder()
+    handler(resp, httptest.NewRequest(method, path, nil))
+    if reply != nil {
+        if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+            t.Fatalf("%s: %s", err, resp.Body.String())
+        }
+    }
+    return resp.Code
+}
+
+func TestRoster(t *testing.T) {
+    h := testHandler(t, util.JsMap{"roster.max_size": "3"})
+    a, _ := h.keys.mint()
+    b, _ := h.keys.mint()
+    c, _ := h.keys.mint()
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{}`, &ping)
+
+    var made rosterResponse
+    if code := call(t, h.RosterHandler, `{"tokens":["` + a + `","` + b +
+        `"]}`, &made); code != http.StatusOK || len(made.Key) == 0 {
+        t.Fatalf("new roster: got %d, %+v", code, made)
+    }
+    auth := `{"id":"` + made.ID + `","key":"` + made.Key + `"`
+    tests := []struct {
+        name   string
+        body   string
+        status int
+        // the members after.
+        tokens []string
+    }{
+        {"add and remove", auth + `,"add":["` + c + `"],"remove":["` + a +
+            `"]}`, http.StatusOK, []string{b, c}},
+        {"replace", auth + `,"tokens":["` + ping.Token + `"]}`,
+            http.StatusOK, []string{ping.Token}},
+        {"wrong key", `{"id":"` + made.ID + `","key":"nope","add":["` + a +
+            `"]}`, http.StatusForbidden, []string{ping.Token}},
+        {"too many", auth + `,"add":["` + a + `","` + b + `","` + c + `"]}`,
+            http.StatusRequestEntityTooLarge, []string{ping.Token}},
+    }
+    for _, test := range tests {
+        if code := call(t, h.RosterHandler, test.body, nil); code != test.status {
+            t.Errorf("%s: got %d, want %d", test.name, code, test.status)
+        }
+        var got rosterResponse
+        if code := callPath(t, h.RosterHandler, "GET",
+            "/1/roster/" + made.ID, &got); code != http.StatusOK {
+            t.Fatalf("%s: get got %d", test.name, code)
+        }
+        if !reflect.DeepEqual(got.Tokens, test.tokens) {
+            t.Errorf("%s: got %v, want %v", test.name, got.Tokens,
+                test.tokens)
+        }
+    }
+
+    // polling the roster polls its members.
+    var poll pollResponse
+    call(t, h.V1PollHandler, `{"roster":"` + made.ID + `"}`, &poll)
+    if len(poll.Results) != 1 || poll.Results[0].Token != ping.Token ||
+        poll.Results[0].State != statePresent {
+        t.Errorf("poll: got %+v", poll.Results)
+    }
+
+    if code := callPath(t, h.RosterHandler, "DELETE", "/1/roster/" +
+        made.ID + "?key=nope", nil); code != http.StatusForbidden {
+        t.Errorf("delete with the wrong key: got %d", code)
+    }
+    if code := callPath(t, h.RosterHandler, "DELETE", "/1/roster/" +
+        made.ID + "?key=" + made.Key, nil); code != http.StatusOK {
+        t.Errorf("delete: got %d", code)
+    }
+    if code := callPath(t, h.RosterHandler, "GET", "/1/roster/" + made.ID,
+        nil); code != http.StatusNotFound {
+        t.Errorf("get after delete: got %d, want 404", code)
+    }
+}
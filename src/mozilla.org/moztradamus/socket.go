@@ -0,0 +1,315 @@
+package moztradamus
+
+// WebSocket presence channel (/1/socket/).
+
+/** One connection does both halves: it keeps the client's own token
+ * present, and pushes changes to the tokens it's watching. Messages are
+ * JSON objects with a "type".
+ *
+ * From the client:
+ *  hello     - {"type":"hello", "token":..., "key":..., "status":...,
+ *              "message":..., "ttl":..., "class":..., "precision":...}.
+ *              Like /1/ping/, but the token then stays present for as
+ *              long as the socket is open, and goes offline when it
+ *              closes.
+ *  ping      - same fields (bar token and key), to change status or
+ *              message. Optional; the server keeps the token alive.
+ *  subscribe - {"type":"subscribe", "tokens":[...], "grants":{...}}.
+ *              Replaces whatever was being watched. Private tokens are
+ *              shown if granted to the hello's token, or with a grant.
+ *              Rate limited as a /1/poll/ for the tokens would be.
+ *  bye       - close, and go offline.
+ *
+ * From the server:
+ *  welcome - {"type":"welcome", "data":{/1/ping/ reply}} after a hello.
+ *  event   - {"type":"event", "event":..., "data":{...}}, as for
+ *            /1/stream/ (a "state" event per token on subscribe).
+ *  error   - {"type":"error", "data":{"status":..., "error":...}}.
+ */
+
+import(
+    "code.google.com/p/go.net/websocket"
+
+    "mozilla.org/moztradamus/storage"
+
+    "net/http"
+    "time"
+)
+
+type socketMessage struct {
+    Type      string            `json:"type"`
+    Token     string            `json:"token"`
+    Key       string            `json:"key"`
+    TTL       int64             `json:"ttl"`
+    Class     string            `json:"class"`
+    Status    string            `json:"status"`
+    Message   string            `json:"message"`
+    Precision string            `json:"precision"`
+    Tokens    []string          `json:"tokens"`
+    Grants    map[string]string `json:"grants"`
+}
+
+type socketReply struct {
+    Type  string      `json:"type"`
+    Event string      `json:"event,omitempty"`
+    Data  interface{} `json:"data"`
+}
+
+// Shortest gap between the pings the server makes for a client.
+const minSocketRefresh = time.Second
+
+// Longest a send may take. A client that isn't reading would otherwise
+// hold its socket (and shutdown) open for good.
+const socketWriteTimeout = 10 * time.Second
+
+func socketSend(ws *websocket.Conn, codec websocket.Codec, v interface{}) error {
+    ws.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+    return codec.Send(ws, v)
+}
+
+// Ping again well before the TTL runs out.
+func socketRefresh(ttl time.Duration) *time.Ticker {
+    every := ttl / 2
+    if every < minSocketRefresh {
+        every = minSocketRefresh
+    }
+    return time.NewTicker(every)
+}
+
+func (self *Handler) SocketHandler(resp http.ResponseWriter, req *http.Request) {
+    if !self.allowRequest(resp, req, self.jsonErr) {
+        return
+    }
+    // open streams and sockets are capped per address, together.
+    addr, ok := self.openStream(resp, req, self.jsonErr)
+    if !ok {
+        return
+    }
+    defer self.limits.streams.release(addr)
+    // Counted before the upgrade, so Close waits for it to the very end.
+    // (ServeHTTP returns once the socket is done with.)
+    if !self.countSocket() {
+        self.jsonErr(resp, "Shutting down", http.StatusServiceUnavailable)
+        return
+    }
+    defer self.sockets.Done()
+    server := websocket.Server{Handler: self.socket,
+        // Mobile clients don't send an Origin, and a write key is
+        // needed to do anything to a token anyway.
+        Handshake: func(*websocket.Config, *http.Request) error {
+            return nil
+        }}
+    server.ServeHTTP(resp, req)
+}
+
+// Count a socket in, unless the server is shutting down.
+func (self *Handler) countSocket() bool {
+    self.socketLock.Lock()
+    defer self.socketLock.Unlock()
+    select {
+    case <-self.closing:
+        return false
+    default:
+    }
+    self.sockets.Add(1)
+    return true
+}
+
+func (self *Handler) socketErr(ws *websocket.Conn, err error) error {
+    aerr, ok := err.(apiError)
+    if !ok {
+        aerr = apiError{err.Error(), http.StatusBadRequest}
+    }
+    return socketSend(ws, websocket.JSON, socketReply{Type: "error",
+        Data: errorResponse{Status: aerr.status, Error: aerr.msg}})
+}
+
+// Count a hello or ping from the client against its token, as for
+// /1/ping/. (The server's own refreshes don't count.)
+func (self *Handler) socketPing(ping *pingRequest) (*storage.Presence, error) {
+    if _, ok := self.takePing(ping.Token, ping.Key); !ok {
+        return nil, apiError{"Too many requests", http.StatusTooManyRequests}
+    }
+    return self.register(ping)
+}
+
+// Take the socket's token offline, unless something else has pinged it
+// since the socket last did (another device sharing the token).
+func (self *Handler) socketOffline(ping *pingRequest, last int64) {
+    p, err := self.store.CheckPing([]byte(ping.Token))
+    if err == nil && p.Last > last {
+        return
+    }
+    self.retire(ping.Token, ping.Key, false)
+}
+
+func (self *Handler) socket(ws *websocket.Conn) {
+    var ping *pingRequest
+    var sub *storage.Subscription
+    // nil until there's something to watch or keep alive.
+    var events <-chan storage.Event
+    var refresh <-chan time.Time
+    var ticker *time.Ticker
+    // when the socket last pinged its token.
+    var last int64
+    // who's asking, for the rate limits.
+    addr := self.limits.clientAddr(ws.Request())
+    // the hello's token, once there is one, and any grants.
+    view := &viewer{}
+    screen := self.screen(view)
+
+    ws.MaxPayloadBytes = int(self.poll.maxBody)
+    defer ws.Close()
+    defer func() {
+        if sub != nil {
+            sub.Close()
+        }
+        if ticker != nil {
+            ticker.Stop()
+        }
+        // socket closed, so the token goes offline.
+        if ping != nil {
+            self.socketOffline(ping, last)
+        }
+    }()
+
+    // Read in the background, so events can go out in the meantime.
+    incoming := make(chan socketMessage)
+    done := make(chan bool)
+    defer close(done)
+    go func() {
+        defer close(incoming)
+        for {
+            var msg socketMessage
+            if err := websocket.JSON.Receive(ws, &msg); err != nil {
+                return
+            }
+            select {
+            case incoming <- msg:
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    keepalive := time.NewTicker(self.stream.keepalive)
+    defer keepalive.Stop()
+    for {
+        var err error
+
+        select {
+        case msg, ok := <-incoming:
+            if !ok {
+                return
+            }
+            switch msg.Type {
+            case "hello":
+                if ping != nil {
+                    err = apiError{"Already said hello", http.StatusBadRequest}
+                    break
+                }
+                hello := &pingRequest{Token: msg.Token, Key: msg.Key,
+                    TTL: msg.TTL, Class: msg.Class,
+                    Status: msg.Status, Message: msg.Message,
+                    Precision: msg.Precision}
+                var presence *storage.Presence
+                if presence, err = self.socketPing(hello); err != nil {
+                    break
+                }
+                ping, last = hello, presence.Last
+                view.token = ping.Token
+                ticker = socketRefresh(presence.TTL)
+                refresh = ticker.C
+                err = socketSend(ws, websocket.JSON, socketReply{Type: "welcome",
+                    Data: pingResponse{Token: ping.Token,
+                        Key: ping.Key,
+                        TTL: int64(presence.TTL / time.Second),
+                        Status: presence.Status}})
+            case "ping":
+                if ping == nil {
+                    err = apiError{"Say hello first", http.StatusBadRequest}
+                    break
+                }
+                update := *ping
+                update.TTL, update.Class = msg.TTL, msg.Class
+                update.Status, update.Message = msg.Status, msg.Message
+                update.Precision = msg.Precision
+                var presence *storage.Presence
+                if presence, err = self.socketPing(&update); err == nil {
+                    ping, last = &update, presence.Last
+                    // the TTL may be shorter now.
+                    ticker.Stop()
+                    ticker = socketRefresh(presence.TTL)
+                    refresh = ticker.C
+                }
+            case "subscribe":
+                if len(msg.Tokens) > self.stream.maxTokens {
+                    err = apiError{"Too many tokens",
+                        http.StatusRequestEntityTooLarge}
+                    break
+                }
+                if _, ok := self.takeWatch(addr, len(msg.Tokens)); !ok {
+                    err = apiError{"Too many requests",
+                        http.StatusTooManyRequests}
+                    break
+                }
+                var tokens []string
+                if tokens, err = canonicalTokens(msg.Tokens); err != nil {
+                    break
+                }
+                var granted *viewer
+                if granted, err = self.viewerFor(nil, msg.Grants); err != nil {
+                    break
+                }
+                view.grants = granted.grants
+                if sub != nil {
+                    sub.Close()
+                }
+                var current []streamEvent
+                sub, current = self.watch(tokens, view)
+                events = sub.C
+                for _, reply := range current {
+                    if err = socketSend(ws, websocket.JSON, socketReply{Type: "event",
+                        Event: "state", Data: reply}); err != nil {
+                        return
+                    }
+                }
+            case "bye":
+                return
+            default:
+                err = apiError{"Unknown message type", http.StatusBadRequest}
+            }
+            if _, ok := err.(apiError); ok {
+                // the client's problem; tell it and carry on.
+                err = self.socketErr(ws, err)
+            }
+        case ev, ok := <-events:
+            if !ok {
+                // fell behind; let the client reconnect.
+                return
+            }
+            name, reply, send := screen.pass(ev, time.Now().UTC().Unix())
+            if send {
+                err = socketSend(ws, websocket.JSON, socketReply{Type: "event",
+                    Event: name, Data: reply})
+            }
+        case <-refresh:
+            presence, rerr := self.register(ping)
+            if rerr != nil {
+                // e.g. revoked or rotated from elsewhere.
+                self.socketErr(ws, rerr)
+                ping = nil
+                return
+            }
+            last = presence.Last
+        case <-keepalive.C:
+            // keeps proxies from timing out an idle connection.
+            err = socketSend(ws, websocket.Message, `{"type":"keepalive"}`)
+        case <-self.closing:
+            return
+        }
+        if err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,47 @@
+package moztradamus
+
+import(
+    "mozilla.org/moztradamus/storage"
+
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// A socket's token stays online if another device pinged it since the
+// socket last did.
+func TestSocketOffline(t *testing.T) {
+    h := testHandler(t, nil)
+    ping := &pingRequest{}
+    presence, err := h.socketPing(ping)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    h.socketOffline(ping, presence.Last - 1)
+    if _, err := h.store.CheckPing([]byte(ping.Token)); err != nil {
+        t.Errorf("pinged since: got %v, want present", err)
+    }
+    h.socketOffline(ping, presence.Last)
+    if _, err := h.store.CheckPing([]byte(ping.Token)); err != storage.ErrOffline {
+        t.Errorf("not pinged since: got %v, want ErrOffline", err)
+    }
+}
+
+// No new sockets once the server is shutting down.
+func TestSocketShutdown(t *testing.T) {
+    h := testHandler(t, nil)
+    if !h.countSocket() {
+        t.Fatal("refused a socket before shutdown")
+    }
+    h.Drain()
+    if h.countSocket() {
+        t.Error("counted a socket after Drain")
+    }
+    resp := httptest.NewRecorder()
+    h.SocketHandler(resp, httptest.NewRequest("GET", "/1/socket/", nil))
+    if resp.Code != http.StatusServiceUnavailable {
+        t.Errorf("upgrade after Drain: got %d, want 503", resp.Code)
+    }
+    h.sockets.Done()
+}
@@ -0,0 +1,503 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// Durable embedded presence store.
+
+/** Presence is held in memory, but every ping is also appended to a log
+ * file in "disk.path". Every "disk.compact_interval" the live records are
+ * written out to a snapshot and the log is started over. On startup the
+ * snapshot and then the log(s) are replayed, so last seen times survive
+ * a restart. The log is flushed and synced every "disk.sync_interval",
+ * which is how much may be lost if the box itself goes down.
+ *
+ * Tokens are forgotten once they've been expired for db.ttl_linger, or
+ * once an offline token has been kept for as long as asked. Revoked and
+ * forwarded tokens are kept for good.
+ *
+ * Rosters are kept as records too, with a status of "roster" and the
+ * members (one per line) as the message, until they're deleted. That
+ * logs a "deleted" record for the roster, which drops it on replay.
+ *
+ * Files are plain text, one record per line:
+ *  "<base64 token> <last> <ttl> <status> <base64 message> <precision>"
+ * with "-" for no message. Older records may stop after <last>, <ttl>
+ * or <status>, or leave out an empty message and the precision.
+ */
+
+import (
+	"mozilla.org/util"
+
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskSnapshot = "presence.snap"
+	diskLog      = "presence.log"
+	// the log being folded into a new snapshot.
+	diskOldLog = "presence.log.old"
+	// status of a record that undoes the one before it.
+	diskDeleted = "deleted"
+)
+
+type diskStore struct {
+	sync.RWMutex
+	logger *util.HekaLogger
+	path   string
+	// (SIGHUP may change db.ttl_linger.)
+	retention *retention
+	records   map[string]record
+	logFile   *os.File
+	log       *bufio.Writer
+	// only one compaction at a time.
+	compacting sync.Mutex
+	done       chan bool
+	wg         sync.WaitGroup
+}
+
+func newDisk(config util.JsMap, logger *util.HekaLogger) (*diskStore, error) {
+	compact, err := time.ParseDuration(util.MzGet(config, "disk.compact_interval", "5m"))
+	if err != nil || compact <= 0 {
+		return nil, StorageError{"Invalid disk.compact_interval"}
+	}
+	syncEvery, err := time.ParseDuration(util.MzGet(config, "disk.sync_interval", "1s"))
+	if err != nil || syncEvery <= 0 {
+		return nil, StorageError{"Invalid disk.sync_interval"}
+	}
+	store := &diskStore{
+		logger:    logger,
+		path:      util.MzGet(config, "disk.path", "presence_db"),
+		retention: newRetention(config, logger),
+		records:   make(map[string]record),
+		done:      make(chan bool),
+	}
+	if err = os.MkdirAll(store.path, 0700); err != nil {
+		return nil, err
+	}
+	if err = store.replay(); err != nil {
+		return nil, err
+	}
+	if err = store.openLog(); err != nil {
+		return nil, err
+	}
+	if logger != nil {
+		logger.Info("storage", "Opened disk store",
+			util.Fields{"path": store.path,
+				"records": strconv.Itoa(len(store.records))})
+	}
+	// Fold anything we just replayed into a fresh snapshot.
+	if err = store.compact(); err != nil {
+		return nil, err
+	}
+	store.wg.Add(2)
+	go store.every(syncEvery, store.sync)
+	go store.every(compact, store.compact)
+	return store, nil
+}
+
+func (self *diskStore) file(name string) string {
+	return filepath.Join(self.path, name)
+}
+
+func (self *diskStore) openLog() (err error) {
+	self.logFile, err = os.OpenFile(self.file(diskLog),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	self.log = bufio.NewWriter(self.logFile)
+	return nil
+}
+
+func encodeDiskRec(pk []byte, rec record) string {
+	status := rec.S
+	if status == "" {
+		status = StatusOnline
+	}
+	// an empty message would encode to nothing.
+	message := "-"
+	if len(rec.M) > 0 {
+		message = keycode([]byte(rec.M))
+	}
+	precision := rec.P
+	if precision == "" {
+		precision = PrecisionExact
+	}
+	return fmt.Sprintf("%s %d %d %s %s %s\n", keycode(pk), rec.L, rec.T,
+		status, message, precision)
+}
+
+func decodeDiskRec(line string) (key string, rec record, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 6 {
+		return "", rec, StorageError{"Malformed record"}
+	}
+	pk := keydecode(fields[0])
+	if len(pk) == 0 {
+		return "", rec, StorageError{"Malformed record key"}
+	}
+	if rec.L, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return "", rec, err
+	}
+	// records from before TTLs were configurable got 15 minutes.
+	rec.T = 900
+	if len(fields) > 2 {
+		if rec.T, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return "", rec, err
+		}
+	}
+	if len(fields) > 3 && fields[3] != StatusOnline {
+		rec.S = fields[3]
+	}
+	// older records left an empty message out.
+	if len(fields) > 4 && fields[4] != "-" {
+		rec.M = string(keydecode(fields[4]))
+	}
+	if len(fields) > 5 && fields[5] != PrecisionExact {
+		rec.P = fields[5]
+	}
+	return string(pk), rec, nil
+}
+
+// Load the snapshot, then any logs, in the order they were written.
+// Only once the latest record for each key is known can it be told
+// whether the key is gone; an older, longer lived record mustn't stand
+// in for it.
+func (self *diskStore) replay() error {
+	for _, name := range []string{diskSnapshot, diskOldLog, diskLog} {
+		if err := self.load(name); err != nil {
+			return err
+		}
+	}
+	now, linger := time.Now().UTC().Unix(), self.retention.Linger()
+	for key, rec := range self.records {
+		if rec.S == diskDeleted || rec.gone(now, linger) {
+			delete(self.records, key)
+		}
+	}
+	return nil
+}
+
+func (self *diskStore) load(name string) error {
+	file, err := os.Open(self.file(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	bad := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A partial last line is from a write that never finished.
+			if len(line) > 0 {
+				bad++
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key, rec, err := decodeDiskRec(line)
+		if err != nil {
+			bad++
+			continue
+		}
+		// on a tie, the later line wins. (Deletions are kept until
+		// replay is done, so an older record can't come back.)
+		if cur, ok := self.records[key]; !ok || cur.L <= rec.L {
+			self.records[key] = rec
+		}
+	}
+	if bad > 0 && self.logger != nil {
+		self.logger.Warn("storage", "Skipped unreadable records",
+			util.Fields{"file": name, "count": strconv.Itoa(bad)})
+	}
+	return nil
+}
+
+func (self *diskStore) RegPing(pk []byte, p *Presence) (err error) {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	if p.Last == 0 {
+		p.Last = time.Now().UTC().Unix()
+	}
+	return self.update(pk, recordOf(p))
+}
+
+func (self *diskStore) Drop(pk []byte, keep time.Duration) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.update(pk, record{L: time.Now().UTC().Unix(),
+		T: ttlSeconds(keep),
+		S: statusOffline})
+}
+
+func (self *diskStore) Revoke(pk []byte) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.put(pk, record{L: time.Now().UTC().Unix(), S: statusRevoked})
+}
+
+func (self *diskStore) Forward(pk, to []byte, grace time.Duration) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.update(pk, record{L: time.Now().UTC().Unix(),
+		T: ttlSeconds(grace),
+		S: statusMoved,
+		M: string(to)})
+}
+
+// Log rec for the token and make it the current record.
+func (self *diskStore) put(pk []byte, rec record) error {
+	self.Lock()
+	defer self.Unlock()
+	return self.write(pk, rec)
+}
+
+// put, unless the token's current record refuses it (it's revoked or
+// forwarded).
+func (self *diskStore) update(pk []byte, rec record) error {
+	self.Lock()
+	defer self.Unlock()
+	if cur, ok := self.records[string(pk)]; ok {
+		if err := cur.refuse(time.Now().UTC().Unix()); err != nil {
+			return err
+		}
+	}
+	return self.write(pk, rec)
+}
+
+// Caller must hold the lock.
+func (self *diskStore) write(pk []byte, rec record) (err error) {
+	if self.log == nil {
+		return StorageError{"Store closed"}
+	}
+	if _, err = self.log.WriteString(encodeDiskRec(pk, rec)); err != nil {
+		if self.logger != nil {
+			self.logger.Error("storage", "Could not write to log",
+				util.Fields{"error": err.Error()})
+		}
+		return err
+	}
+	if rec.S == diskDeleted {
+		delete(self.records, string(pk))
+	} else {
+		self.records[string(pk)] = rec
+	}
+	return nil
+}
+
+func (self *diskStore) GetRoster(id []byte) ([][]byte, error) {
+	self.RLock()
+	defer self.RUnlock()
+	rec, ok := self.records[string(rosterKey(id))]
+	if !ok || rec.S != statusRoster {
+		return nil, ErrNotFound
+	}
+	return splitMembers(rec.M), nil
+}
+
+func (self *diskStore) GetRosters(ids [][]byte) ([][][]byte, error) {
+	results := make([][][]byte, len(ids))
+	for i, id := range ids {
+		results[i], _ = self.GetRoster(id)
+	}
+	return results, nil
+}
+
+func (self *diskStore) PutRoster(id []byte, members [][]byte) error {
+	if id == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.put(rosterKey(id), record{L: time.Now().UTC().Unix(),
+		S: statusRoster,
+		M: joinMembers(members)})
+}
+
+func (self *diskStore) DelRoster(id []byte) error {
+	return self.put(rosterKey(id), record{L: time.Now().UTC().Unix(),
+		S: diskDeleted})
+}
+
+func (self *diskStore) CheckPing(pk []byte) (rep *Presence, err error) {
+	if pk == nil {
+		return nil, StorageError{"Invalid Primary Key"}
+	}
+	self.RLock()
+	rec, ok := self.records[string(pk)]
+	self.RUnlock()
+	now := time.Now().UTC().Unix()
+	if !ok || rec.gone(now, self.retention.Linger()) {
+		return nil, ErrNotFound
+	}
+	return rec.check(now)
+}
+
+func (self *diskStore) CheckPings(pks [][]byte) (results []Result, err error) {
+	results = make([]Result, len(pks))
+	for i, pk := range pks {
+		results[i].Presence, results[i].Err = self.CheckPing(pk)
+	}
+	return results, nil
+}
+
+// Flush the log out to disk.
+func (self *diskStore) sync() error {
+	self.Lock()
+	defer self.Unlock()
+	return self.syncLocked()
+}
+
+func (self *diskStore) syncLocked() error {
+	if self.log == nil {
+		return nil
+	}
+	if err := self.log.Flush(); err != nil {
+		return err
+	}
+	return self.logFile.Sync()
+}
+
+// Write the live records to a new snapshot and start a new log.
+// Pings carry on while the snapshot is written, they go to the new log.
+func (self *diskStore) compact() (err error) {
+	self.compacting.Lock()
+	defer self.compacting.Unlock()
+
+	self.Lock()
+	if self.log == nil {
+		self.Unlock()
+		return nil
+	}
+	err = self.syncLocked()
+	// If the last compaction failed, the old log is still waiting to be
+	// folded in. Leave the current log alone rather than clobber it.
+	if _, serr := os.Stat(self.file(diskOldLog)); err == nil && os.IsNotExist(serr) {
+		self.logFile.Close()
+		err = os.Rename(self.file(diskLog), self.file(diskOldLog))
+		// reopen regardless, so pings have somewhere to go.
+		if oerr := self.openLog(); err == nil {
+			err = oerr
+		}
+	}
+	if err != nil {
+		self.Unlock()
+		return err
+	}
+	now, linger := time.Now().UTC().Unix(), self.retention.Linger()
+	live := make(map[string]record, len(self.records))
+	for key, rec := range self.records {
+		if rec.gone(now, linger) {
+			delete(self.records, key)
+			continue
+		}
+		live[key] = rec
+	}
+	self.Unlock()
+
+	tmpName := self.file(diskSnapshot + ".tmp")
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for key, rec := range live {
+		if _, err = writer.WriteString(encodeDiskRec([]byte(key), rec)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpName, self.file(diskSnapshot))
+	}
+	if err != nil {
+		// The old log is still around, so nothing is lost; it'll be
+		// picked up by the next replay.
+		os.Remove(tmpName)
+		return err
+	}
+	os.Remove(self.file(diskOldLog))
+	if self.logger != nil {
+		self.logger.Debug("storage", "Compacted disk store",
+			util.Fields{"records": strconv.Itoa(len(live))})
+	}
+	return nil
+}
+
+func (self *diskStore) every(interval time.Duration, task func() error) {
+	defer self.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			if err := task(); err != nil && self.logger != nil {
+				self.logger.Error("storage", "Disk store maintenance failed",
+					util.Fields{"error": err.Error()})
+			}
+		}
+	}
+}
+
+func (self *diskStore) Status() (success bool, err error) {
+	self.RLock()
+	defer self.RUnlock()
+	if self.log == nil {
+		return false, StorageError{"Store closed"}
+	}
+	return true, nil
+}
+
+func (self *diskStore) Close() {
+	close(self.done)
+	self.wg.Wait()
+	self.Lock()
+	defer self.Unlock()
+	if err := self.syncLocked(); err != nil && self.logger != nil {
+		self.logger.Error("storage", "Could not sync log on close",
+			util.Fields{"error": err.Error()})
+	}
+	if self.logFile != nil {
+		self.logFile.Close()
+	}
+	self.log = nil
+	self.logFile = nil
+}
+
+func (self *diskStore) ReloadKeys() []string {
+	return retentionKeys
+}
+
+func (self *diskStore) Reload(config util.JsMap) {
+	self.retention.reload(config, self.logger)
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
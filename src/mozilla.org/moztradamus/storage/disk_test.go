@@ -0,0 +1,132 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeDiskRec(t *testing.T) {
+	pk := []byte("token")
+	full := record{L: 1400000000, T: 60, S: StatusAway, M: "lunch",
+		P: PrecisionBucket}
+	tests := []struct {
+		name string
+		line string
+		rec  record
+		ok   bool
+	}{
+		{"round trip", encodeDiskRec(pk, full), full, true},
+		{"defaults", encodeDiskRec(pk, record{L: 1, T: 900}),
+			record{L: 1, T: 900}, true},
+		{"no TTL (old)", keycode(pk) + " 5\n", record{L: 5, T: 900}, true},
+		{"no message (old)", keycode(pk) + " 5 60 busy\n",
+			record{L: 5, T: 60, S: StatusBusy}, true},
+		{"deleted", keycode(pk) + " 5 0 deleted -\n",
+			record{L: 5, S: diskDeleted}, true},
+		{"too short", keycode(pk) + "\n", record{}, false},
+		{"too long", keycode(pk) + " 1 2 online - exact extra\n",
+			record{}, false},
+		{"bad key", "!!! 5 60\n", record{}, false},
+		{"bad time", keycode(pk) + " soon 60\n", record{}, false},
+		{"bad TTL", keycode(pk) + " 5 long\n", record{}, false},
+	}
+	for _, test := range tests {
+		key, rec, err := decodeDiskRec(test.line)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if key != string(pk) {
+			t.Errorf("%s: got key %q", test.name, key)
+		}
+		if rec != test.rec {
+			t.Errorf("%s: got %+v, want %+v", test.name, rec, test.rec)
+		}
+	}
+}
+
+// Write the files a disk store replays, open one on them and return it.
+func replayed(t *testing.T, files map[string][]string) *diskStore {
+	dir, err := ioutil.TempDir("", "moz_disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, lines := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte(strings.Join(lines, "")), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := newDisk(util.JsMap{"disk.path": dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestDiskLoad(t *testing.T) {
+	now := time.Now().UTC().Unix()
+	a, b, c, d := []byte("a"), []byte("b"), []byte("c"), []byte("d")
+	store := replayed(t, map[string][]string{
+		diskSnapshot: {
+			// a's long lived ping was replaced by a short one that's
+			// long gone; the old one mustn't come back.
+			encodeDiskRec(a, record{L: now - 7200, T: 259200}),
+			encodeDiskRec(b, record{L: now - 60, T: 900}),
+			encodeDiskRec(c, record{L: now - 60, T: 900}),
+			encodeDiskRec(d, record{L: now - 60, T: 900}),
+		},
+		diskOldLog: {
+			encodeDiskRec(a, record{L: now - 7140, T: 900}),
+			// deleted, then an older record turns up in a later file.
+			encodeDiskRec(c, record{L: now - 30, S: diskDeleted}),
+		},
+		diskLog: {
+			encodeDiskRec(b, record{L: now - 10, T: 900, S: StatusBusy}),
+			encodeDiskRec(c, record{L: now - 60, T: 900}),
+			encodeDiskRec(d, record{L: now - 5, S: statusRevoked}),
+			// a write that never finished.
+			"ZA== 12",
+		},
+	})
+	tests := []struct {
+		pk     []byte
+		err    error
+		status string
+	}{
+		{a, ErrNotFound, ""},
+		{b, nil, StatusBusy},
+		{c, ErrNotFound, ""},
+		{d, ErrRevoked, ""},
+	}
+	for _, test := range tests {
+		p, err := store.CheckPing(test.pk)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.pk, err, test.err)
+			continue
+		}
+		if err == nil && p.Status != test.status {
+			t.Errorf("%s: got status %q, want %q", test.pk, p.Status,
+				test.status)
+		}
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,746 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// thin memcache wrapper
+
+/** This backend uses libmemcache (via gomc) to do most of it's work.
+ * libmemcache handles key sharding, multiple nodes, node balancing, etc.
+ */
+
+import (
+	"github.com/ianoshen/gomc"
+
+	"mozilla.org/util"
+
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type mcStore struct {
+	config util.JsMap
+	// (SIGHUP may change db.ttl_linger.)
+	retention  *retention
+	mcs        chan *mcClient
+	logger     *util.HekaLogger
+	mc_timeout time.Duration
+	// config, servers and gen can change on Reload.
+	poolLock sync.Mutex
+	servers  []string
+	gen      int
+	// makes a client for a server list. (gomcDial, bar tests.)
+	dial func([]string, util.JsMap, *util.HekaLogger) mcConn
+}
+
+// A pooled client, and which server list (mcStore.gen) it's for.
+type mcClient struct {
+	mcConn
+	gen int
+}
+
+// What the store asks of a memcache client. (gomcConn in production;
+// tests use a fake.)
+type mcConn interface {
+	Get(key string, val interface{}) error
+	// One round trip. Keys that weren't found are missing from the
+	// result.
+	GetMulti(keys []string) (mcItems, error)
+	Set(key string, val interface{}, exp time.Duration) error
+	Delete(key string, exp time.Duration) error
+	Close()
+}
+
+type mcItems interface {
+	Get(key string, val interface{}) error
+}
+
+type gomcConn struct {
+	mc gomc.Client
+}
+
+func (self gomcConn) Get(key string, val interface{}) error {
+	return self.mc.Get(key, val)
+}
+
+func (self gomcConn) GetMulti(keys []string) (mcItems, error) {
+	items, err := self.mc.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (self gomcConn) Set(key string, val interface{}, exp time.Duration) error {
+	return self.mc.Set(key, val, exp)
+}
+
+func (self gomcConn) Delete(key string, exp time.Duration) error {
+	return self.mc.Delete(key, exp)
+}
+
+func (self gomcConn) Close() {
+	self.mc.Close()
+}
+
+func gomcDial(servers []string, config util.JsMap, logger *util.HekaLogger) mcConn {
+	return gomcConn{newMC(servers, config, logger)}
+}
+
+var mcsPoolSize int32
+
+// Attempting to use dynamic pools seems to cause all sorts of problems.
+// The first being that the pool channel can't be resized once it's built
+// in New(). The other being that during shutdown, go throws a popdefer
+// phase error that I've not been able to chase the source. Since this doesn't
+// happen for statically set pools, I'm going to go with that for now.
+// var mcsMaxPoolSize int32
+
+// Use the AWS system to query for the endpoints to use.
+// (Allows for dynamic endpoint assignments)
+func getElastiCacheEndpoints(configEndpoint string) (string, error) {
+	c, err := net.Dial("tcp", configEndpoint)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	reader, writer := bufio.NewReader(c), bufio.NewWriter(c)
+	writer.Write([]byte("config get cluster\r\n"))
+	writer.Flush()
+
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", nil
+	}
+
+	endPoints := strings.Split(line, " ")
+	if len(endPoints) < 1 {
+		return "", errors.New("Elasticache returned no endPoints")
+	}
+
+	retEndpoints := make([]string, 0)
+	for _, v := range endPoints {
+		endPoint := strings.Split(v, "|")
+		if len(endPoint) < 3 {
+			continue
+		}
+		retEndpoints = append(retEndpoints, fmt.Sprintf("%s:%s", endPoint[1], strings.TrimSpace(endPoint[2])))
+	}
+	return strings.Join(retEndpoints, ","), nil
+}
+
+func getElastiCacheEndpointsTimeout(configEndpoint string, seconds int) (string, error) {
+	type strErr struct {
+		ep  string
+		err error
+	}
+
+	ch := make(chan strErr)
+
+	go func() {
+		ep, err := getElastiCacheEndpoints(configEndpoint)
+		ch <- strErr{ep, err}
+	}()
+	select {
+	case se := <-ch:
+		return se.ep, se.err
+	case <-time.After(time.Duration(seconds) * time.Second):
+		return "", errors.New("Elasticache config timeout")
+	}
+
+}
+
+func newMemcache(config util.JsMap, logger *util.HekaLogger) (*mcStore, error) {
+	var ok bool
+	var err error
+
+	servers := mcServers(config, logger)
+
+	timeout, err := time.ParseDuration(util.MzGet(config, "db.handle_timeout", "5s"))
+	if err != nil {
+		if logger != nil {
+			logger.Error("storage", "Could not parse db.handle_timeout",
+				util.Fields{"err": err.Error()})
+		}
+		timeout = 10 * time.Second
+	}
+	if _, ok = config["memcache.pool_size"]; !ok {
+		config["memcache.pool_size"] = "100"
+	}
+	if config["memcache.pool_size"], err =
+		strconv.ParseInt(config["memcache.pool_size"].(string), 0, 0); err != nil {
+		config["memcache.pool_size"] = 100
+	}
+	poolSize := int(config["memcache.pool_size"].(int64))
+	/*
+		i, err := strconv.ParseInt(util.MzGet(config,
+			"memcache.max_pool_size", "400"), 0, 10)
+		if err != nil {
+			if logger != nil {
+				logger.Error("storage", "Could not parse memcache.max_pool_size",
+					util.Fields{"error": err.Error()})
+			}
+			mcsMaxPoolSize = 400
+		}
+		mcsMaxPoolSize = int32(i)
+	*/
+
+	if logger != nil {
+		logger.Info("storage", "Creating new gomc handler", nil)
+	}
+	mcs := make(chan *mcClient, poolSize)
+	for i := 0; i < poolSize; i++ {
+		mcs <- &mcClient{mcConn: gomcDial(servers, config, logger)}
+	}
+
+	return &mcStore{
+		mcs:        mcs,
+		config:     config,
+		retention:  newRetention(config, logger),
+		logger:     logger,
+		mc_timeout: timeout,
+		servers:    servers,
+		dial:       gomcDial,
+	}, nil
+}
+
+// The memcache servers to use: from elasticache.config_endpoint if
+// that's set (and answers), otherwise memcache.server.
+func mcServers(config util.JsMap, logger *util.HekaLogger) []string {
+	if configEndpoint, ok := config["elasticache.config_endpoint"]; ok {
+		memcacheEndpoint, err := getElastiCacheEndpointsTimeout(configEndpoint.(string), 2)
+		if err == nil {
+			config["memcache.server"] = memcacheEndpoint
+		} else {
+			fmt.Println(err)
+			if logger != nil {
+				logger.Error("storage", "Elastisearch error.",
+					util.Fields{"error": err.Error()})
+			}
+		}
+	}
+
+	if _, ok := config["memcache.server"]; !ok {
+		config["memcache.server"] = "127.0.0.1:11211"
+	}
+	// do NOT include any spaces
+	return strings.Split(
+		no_whitespace.Replace(config["memcache.server"].(string)),
+		",")
+}
+
+// Generate a new Memcache Client
+func newMC(servers []string, config util.JsMap, logger *util.HekaLogger) (mc gomc.Client) {
+	var err error
+	/*	if mcsPoolSize >= mcsMaxPoolSize {
+			return nil
+		}
+	*/
+	mc, err = gomc.NewClient(servers, 1, gomc.ENCODING_GOB)
+	if err != nil {
+		logger.Critical("storage", "CRITICAL HIT!",
+			util.Fields{"error": err.Error()})
+	}
+	// internally hash key using MD5 (for key distribution)
+	mc.SetBehavior(gomc.BEHAVIOR_KETAMA_HASH, 1)
+	// Use the binary protocol, which allows us faster data xfer
+	// and better data storage (can use full UTF-8 char space)
+	mc.SetBehavior(gomc.BEHAVIOR_BINARY_PROTOCOL, 1)
+	//mc.SetBehavior(gomc.BEHAVIOR_NO_BLOCK, 1)
+	// NOTE! do NOT set BEHAVIOR_NOREPLY + Binary. This will cause
+	// libmemcache to drop into an infinite loop.
+	if v, ok := config["memcache.recv_timeout"]; ok {
+		d, err := time.ParseDuration(v.(string))
+		if err == nil {
+			mc.SetBehavior(gomc.BEHAVIOR_SND_TIMEOUT,
+				uint64(d.Nanoseconds()*1000))
+		}
+	}
+	if v, ok := config["memcache.send_timeout"]; ok {
+		d, err := time.ParseDuration(v.(string))
+		if err == nil {
+			mc.SetBehavior(gomc.BEHAVIOR_RCV_TIMEOUT,
+				uint64(d.Nanoseconds()*1000))
+		}
+	}
+	if v, ok := config["memcache.poll_timeout"]; ok {
+		d, err := time.ParseDuration(v.(string))
+		if err == nil {
+			mc.SetBehavior(gomc.BEHAVIOR_POLL_TIMEOUT,
+				uint64(d.Nanoseconds()*1000))
+		}
+	}
+	if v, ok := config["memcache.retry_timeout"]; ok {
+		d, err := time.ParseDuration(v.(string))
+		if err == nil {
+			mc.SetBehavior(gomc.BEHAVIOR_RETRY_TIMEOUT,
+				uint64(d.Nanoseconds()*1000))
+		}
+	}
+	atomic.AddInt32(&mcsPoolSize, 1)
+	return mc
+}
+
+func (self *mcStore) fetchRec(pk []byte) (result *record, err error) {
+	//fetch a record from Memcache
+	result = &record{}
+	if pk == nil {
+		err = StorageError{"Invalid Primary Key"}
+		return nil, err
+	}
+
+	defer func() {
+		if recv := recover(); recv != nil {
+			// not the empty record, that would read as a (very old) ping.
+			result = nil
+			if e, ok := recv.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", recv)
+			}
+			if self.logger != nil {
+				self.logger.Error("storage",
+					fmt.Sprintf("could not fetch record for %s", pk),
+					util.Fields{"primarykey": keycode(pk),
+						"error": err.Error()})
+			}
+		}
+	}()
+
+	mc, err := self.getMC()
+	defer self.returnMC(mc)
+	if err != nil {
+		return nil, err
+	}
+	//mc.Timeout = time.Second * 10
+	err = mc.Get(keycode(pk), result)
+	if err != nil && strings.Contains(strings.ToUpper(err.Error()), "NOT FOUND") {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		if self.logger != nil {
+			self.logger.Error("storage",
+				"Get Failed",
+				util.Fields{"primarykey": hex.EncodeToString(pk),
+					"error": err.Error()})
+		}
+		return nil, err
+	}
+
+	if self.logger != nil {
+		self.logger.Debug("storage",
+			"Fetched",
+			util.Fields{"primarykey": hex.EncodeToString(pk),
+				"result": fmt.Sprintf("last: %d, status: %q",
+					result.L, result.S),
+			})
+	}
+	return result, err
+}
+
+func (self *mcStore) storeRec(pk []byte, rec *record) (err error) {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+
+	if rec == nil {
+		err = StorageError{"No Data to Store"}
+		return err
+	}
+
+	if rec.L == 0 {
+		rec.L = time.Now().UTC().Unix()
+	}
+
+	mc, err := self.getMC()
+	defer self.returnMC(mc)
+	if err != nil {
+		return err
+	}
+
+	// 0 is "never expire" to memcache too.
+	err = mc.Set(keycode(pk), rec,
+		time.Duration(rec.keep(self.retention.Linger()))*time.Second)
+	if err != nil {
+		if self.logger != nil {
+			self.logger.Error("storage",
+				"Failure to set item",
+				util.Fields{"primarykey": keycode(pk),
+					"error": err.Error()})
+		}
+	}
+	return err
+}
+
+func (self *mcStore) RegPing(pk []byte, p *Presence) (err error) {
+	rec := recordOf(p)
+	log.Printf("Storing rec %v", rec)
+	if err = self.update(pk, &rec); err == nil {
+		p.Last = rec.L
+	}
+	return err
+}
+
+// storeRec, unless the token has been revoked or forwarded. There's no
+// check and set to be had, so it looks again once it's stored, and if a
+// Revoke or Forward got in first, puts its record back.
+func (self *mcStore) update(pk []byte, rec *record) error {
+	cur, err := self.retired(pk)
+	if err != nil {
+		return err
+	}
+	if cur != nil {
+		return cur.refuse(time.Now().UTC().Unix())
+	}
+	if err = self.storeRec(pk, rec); err != nil {
+		return err
+	}
+	if cur, err = self.retired(pk); err != nil || cur == nil {
+		return err
+	}
+	self.storeRec(pk, cur)
+	return cur.refuse(time.Now().UTC().Unix())
+}
+
+// The record kept under the token's revokedKey, or nil if there's none.
+func (self *mcStore) retired(pk []byte) (*record, error) {
+	rec, err := self.fetchRec(revokedKey(pk))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return rec, err
+}
+
+func (self *mcStore) CheckPing(pk []byte) (rep *Presence, err error) {
+	if pk == nil {
+		return nil, StorageError{"Invalid Primary Key"}
+	}
+	results, err := self.CheckPings([][]byte{pk})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].Presence, results[0].Err
+}
+
+// Fetch the records (and any revocations) in one multi-get per batch.
+func (self *mcStore) CheckPings(pks [][]byte) (results []Result, err error) {
+	defer func() {
+		if recv := recover(); recv != nil {
+			results = nil
+			if e, ok := recv.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", recv)
+			}
+			if self.logger != nil {
+				self.logger.Error("storage", "could not fetch records",
+					util.Fields{"error": err.Error()})
+			}
+		}
+	}()
+
+	results = make([]Result, len(pks))
+	mc, err := self.getMC()
+	defer self.returnMC(mc)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Unix()
+	for start := 0; start < len(pks); start += batchSize {
+		end := start + batchSize
+		if end > len(pks) {
+			end = len(pks)
+		}
+		// each token's key, then its revocation's.
+		keys := make([]string, 0, 2*(end-start))
+		for _, pk := range pks[start:end] {
+			keys = append(keys, keycode(pk), keycode(revokedKey(pk)))
+		}
+		items, err := mc.GetMulti(keys)
+		if err != nil {
+			if self.logger != nil {
+				self.logger.Error("storage", "GetMulti Failed",
+					util.Fields{"count": strconv.Itoa(len(keys)),
+						"error": err.Error()})
+			}
+			return nil, err
+		}
+		for i := 0; i < end-start; i++ {
+			rec := &record{}
+			// missing keys just aren't in the reply. A revocation (or
+			// forward) outranks whatever the token's own record says.
+			if items.Get(keys[2*i+1], rec) != nil &&
+				items.Get(keys[2*i], rec) != nil {
+				results[start+i].Err = ErrNotFound
+				continue
+			}
+			results[start+i].Presence, results[start+i].Err = rec.check(now)
+		}
+	}
+	return results, nil
+}
+
+func (self *mcStore) Drop(pk []byte, keep time.Duration) error {
+	return self.update(pk, &record{T: ttlSeconds(keep), S: statusOffline})
+}
+
+// Revocations are kept under a key of their own, as well as in the
+// token's record, and memcache is told never to expire it. It can still
+// be evicted if memcache runs short of memory (unless it's run with -M),
+// and then the token works again. (Forward does the same.)
+func (self *mcStore) Revoke(pk []byte) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	if err := self.storeRec(revokedKey(pk), &record{S: statusRevoked}); err != nil {
+		return err
+	}
+	return self.storeRec(pk, &record{S: statusRevoked})
+}
+
+// Where a token's revocation is kept: a key no token can have.
+func revokedKey(pk []byte) []byte {
+	return append([]byte("revoked:"), pk...)
+}
+
+func (self *mcStore) Forward(pk, to []byte, grace time.Duration) error {
+	rec := &record{T: ttlSeconds(grace), S: statusMoved, M: string(to)}
+	if err := self.update(pk, rec); err != nil {
+		return err
+	}
+	return self.storeRec(revokedKey(pk), rec)
+}
+
+// A roster is a record of its own, that memcache is told never to
+// expire. It can still be evicted if memcache runs short of memory, and
+// is subject to the item size limit (1MB by default).
+func (self *mcStore) GetRoster(id []byte) ([][]byte, error) {
+	rec, err := self.fetchRec(rosterKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if rec.S != statusRoster {
+		return nil, ErrNotFound
+	}
+	return splitMembers(rec.M), nil
+}
+
+func (self *mcStore) GetRosters(ids [][]byte) (results [][][]byte, err error) {
+	defer func() {
+		if recv := recover(); recv != nil {
+			results = nil
+			if e, ok := recv.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", recv)
+			}
+		}
+	}()
+
+	results = make([][][]byte, len(ids))
+	mc, err := self.getMC()
+	defer self.returnMC(mc)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, keycode(rosterKey(id)))
+		}
+		items, err := mc.GetMulti(keys)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			rec := &record{}
+			if items.Get(key, rec) == nil && rec.S == statusRoster {
+				results[start+i] = splitMembers(rec.M)
+			}
+		}
+	}
+	return results, nil
+}
+
+func (self *mcStore) PutRoster(id []byte, members [][]byte) error {
+	if id == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.storeRec(rosterKey(id), &record{S: statusRoster,
+		M: joinMembers(members)})
+}
+
+func (self *mcStore) DelRoster(id []byte) (err error) {
+	mc, err := self.getMC()
+	defer self.returnMC(mc)
+	if err != nil {
+		return err
+	}
+	err = mc.Delete(keycode(rosterKey(id)), 0)
+	if err != nil && strings.Contains(strings.ToUpper(err.Error()), "NOT FOUND") {
+		return nil
+	}
+	return err
+}
+
+// Close every client in the pool, waiting (up to db.handle_timeout
+// each) for any that are out.
+func (self *mcStore) Close() {
+	for i := 0; i < cap(self.mcs); i++ {
+		select {
+		case mc := <-self.mcs:
+			if mc != nil {
+				mc.Close()
+			}
+		case <-time.After(self.mc_timeout):
+			if self.logger != nil {
+				self.logger.Error("storage",
+					"Gave up waiting for memcache clients",
+					util.Fields{"closed": strconv.Itoa(i)})
+			}
+			return
+		}
+	}
+}
+
+func (self *mcStore) Status() (success bool, err error) {
+	defer func() {
+		if recv := recover(); recv != nil {
+			success = false
+			if e, ok := recv.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", recv)
+			}
+			return
+		}
+	}()
+
+	fake_id := "_fake_id"
+	key := "status_" + fake_id
+	mc, err := self.getMC()
+	defer self.returnMC(mc)
+	if err != nil {
+		return false, err
+	}
+	err = mc.Set("status_"+fake_id, "test", 6*time.Second)
+	if err != nil {
+		return false, err
+	}
+	var val string
+	err = mc.Get(key, &val)
+	if err != nil || val != "test" {
+		return false, errors.New("Invalid value returned")
+	}
+	mc.Delete(key, time.Duration(0))
+	return true, nil
+}
+
+func (self *mcStore) returnMC(mc *mcClient) {
+	if mc != nil {
+		atomic.AddInt32(&mcsPoolSize, 1)
+		self.mcs <- self.current(mc)
+	}
+}
+
+// mc, or if the server list has changed since it was made, a new client
+// in its place.
+func (self *mcStore) current(mc *mcClient) *mcClient {
+	self.poolLock.Lock()
+	defer self.poolLock.Unlock()
+	if mc.gen == self.gen {
+		return mc
+	}
+	mc.Close()
+	return &mcClient{mcConn: self.dial(self.servers, self.config, self.logger),
+		gen: self.gen}
+}
+
+func (self *mcStore) ReloadKeys() []string {
+	return append([]string{"memcache.server", "elasticache.config_endpoint"},
+		retentionKeys...)
+}
+
+// Switch to the server list in config. Idle clients are replaced now,
+// ones in use as they come back. (The pool stays the same size.)
+func (self *mcStore) Reload(config util.JsMap) {
+	self.retention.reload(config, self.logger)
+	servers := mcServers(config, self.logger)
+	self.poolLock.Lock()
+	if strings.Join(servers, ",") == strings.Join(self.servers, ",") {
+		self.poolLock.Unlock()
+		return
+	}
+	self.servers = servers
+	self.config = config
+	self.gen++
+	self.poolLock.Unlock()
+	if self.logger != nil {
+		self.logger.Info("storage", "Switching memcache servers",
+			util.Fields{"servers": strings.Join(servers, ",")})
+	}
+	for i, idle := 0, len(self.mcs); i < idle; i++ {
+		select {
+		case mc := <-self.mcs:
+			// there's room, it was just taken out.
+			self.mcs <- self.current(mc)
+		default:
+			return
+		}
+	}
+}
+
+func (self *mcStore) getMC() (*mcClient, error) {
+	select {
+	case mc := <-self.mcs:
+		if mc == nil {
+			log.Printf("NULL MC!")
+			return nil, StorageError{"Connection Pool Saturated"}
+		}
+		atomic.AddInt32(&mcsPoolSize, -1)
+		return mc, nil
+	case <-time.After(self.mc_timeout):
+		// As noted before, dynamic pool sizing turns out to be deeply
+		// problematic at this time.
+		// TODO: Investigate why go throws the popdefer phase error on
+		// socket shutdown.
+		/*		if mcsPoolSize < mcsMaxPoolSize {
+					if self.logger != nil {
+						self.logger.Warn("storage", "Increasing Pool Size",
+							util.Fields{"poolSize": strconv.FormatInt(int64(mcsPoolSize+1), 10)})
+					}
+					return newMC(self.servers,
+						self.config,
+						self.logger), nil
+				} else {
+		*/
+		if self.logger != nil {
+			self.logger.Error("storage", "Connection Pool Saturated!", nil)
+		} else {
+			log.Printf("Connection Pool Saturated!")
+		}
+		// mc := self.NewMC(self.servers, self.config)
+		return nil, StorageError{"Connection Pool Saturated"}
+		//		}
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
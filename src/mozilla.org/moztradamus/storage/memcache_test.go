@@ -0,0 +1,206 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in process stand in for memcached, shared by every client in a
+// pool. Values are gob encoded, as gomc.ENCODING_GOB does.
+type fakeMemcache struct {
+	sync.Mutex
+	items map[string]fakeItem
+	// clients closed.
+	closed int
+}
+
+type fakeItem struct {
+	val     []byte
+	expires time.Time
+}
+
+type fakeMCConn struct {
+	*fakeMemcache
+}
+
+type fakeMCItems map[string][]byte
+
+var errFakeNotFound = errors.New("NOT FOUND")
+
+func decodeFake(val []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(val)).Decode(v)
+}
+
+func (self fakeMCItems) Get(key string, v interface{}) error {
+	val, ok := self[key]
+	if !ok {
+		return errFakeNotFound
+	}
+	return decodeFake(val, v)
+}
+
+// Caller holds the lock.
+func (self fakeMCConn) lookup(key string) ([]byte, bool) {
+	item, ok := self.items[key]
+	if ok && !item.expires.IsZero() && !time.Now().Before(item.expires) {
+		delete(self.items, key)
+		return nil, false
+	}
+	return item.val, ok
+}
+
+func (self fakeMCConn) Get(key string, v interface{}) error {
+	self.Lock()
+	val, ok := self.lookup(key)
+	self.Unlock()
+	if !ok {
+		return errFakeNotFound
+	}
+	return decodeFake(val, v)
+}
+
+func (self fakeMCConn) GetMulti(keys []string) (mcItems, error) {
+	self.Lock()
+	defer self.Unlock()
+	items := make(fakeMCItems)
+	for _, key := range keys {
+		if val, ok := self.lookup(key); ok {
+			items[key] = val
+		}
+	}
+	return items, nil
+}
+
+func (self fakeMCConn) Set(key string, v interface{}, exp time.Duration) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	item := fakeItem{val: buf.Bytes()}
+	if exp > 0 {
+		item.expires = time.Now().Add(exp)
+	}
+	self.Lock()
+	self.items[key] = item
+	self.Unlock()
+	return nil
+}
+
+func (self fakeMCConn) Delete(key string, exp time.Duration) error {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.lookup(key); !ok {
+		return errFakeNotFound
+	}
+	delete(self.items, key)
+	return nil
+}
+
+func (self fakeMCConn) Close() {
+	self.Lock()
+	self.closed++
+	self.Unlock()
+}
+
+// An mcStore with a pool of clients for a fake of its own. Each server
+// list it's switched to gets another fake; store.dial(servers, ...)
+// reaches the one for servers.
+func newTestMemcache(t *testing.T) *mcStore {
+	fakes := make(map[string]*fakeMemcache)
+	dial := func(servers []string, _ util.JsMap, _ *util.HekaLogger) mcConn {
+		key := strings.Join(servers, ",")
+		fake, ok := fakes[key]
+		if !ok {
+			fake = &fakeMemcache{items: make(map[string]fakeItem)}
+			fakes[key] = fake
+		}
+		return fakeMCConn{fake}
+	}
+	servers := []string{"127.0.0.1:11211"}
+	store := &mcStore{mcs: make(chan *mcClient, 4),
+		config:     util.JsMap{},
+		retention:  newRetention(util.JsMap{}, nil),
+		mc_timeout: time.Second,
+		servers:    servers,
+		dial:       dial}
+	for i := 0; i < cap(store.mcs); i++ {
+		store.mcs <- &mcClient{mcConn: dial(servers, nil, nil)}
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func fakeFor(store *mcStore, servers string) *fakeMemcache {
+	store.poolLock.Lock()
+	defer store.poolLock.Unlock()
+	return store.dial(strings.Split(servers, ","), nil, nil).(fakeMCConn).fakeMemcache
+}
+
+func TestMemcacheStatus(t *testing.T) {
+	store := newTestMemcache(t)
+	if ok, err := store.Status(); !ok || err != nil {
+		t.Errorf("got (%v, %v)", ok, err)
+	}
+}
+
+// A new server list replaces idle clients straight away, and ones in
+// use once they're handed back.
+func TestMemcacheReload(t *testing.T) {
+	store := newTestMemcache(t)
+	pk := []byte("token")
+	store.RegPing(pk, &Presence{TTL: time.Minute})
+
+	out, err := store.getMC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Reload(util.JsMap{"memcache.server": "10.0.0.1:11211, 10.0.0.2:11211"})
+	old := fakeFor(store, "127.0.0.1:11211")
+	if old.closed != 3 {
+		t.Errorf("idle clients closed: got %d, want 3", old.closed)
+	}
+	store.returnMC(out)
+	if old.closed != 4 {
+		t.Errorf("after the last came back: got %d, want 4", old.closed)
+	}
+	// the new servers don't have the old one's data.
+	if _, err := store.CheckPing(pk); err != ErrNotFound {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	store.RegPing(pk, &Presence{TTL: time.Minute})
+	if len(fakeFor(store, "10.0.0.1:11211,10.0.0.2:11211").items) == 0 {
+		t.Errorf("nothing went to the new servers")
+	}
+	if got := store.ReloadKeys(); len(got) == 0 || got[0] != "memcache.server" {
+		t.Errorf("ReloadKeys: got %v", got)
+	}
+}
+
+// Close closes every client, but doesn't wait forever for one that's
+// out.
+func TestMemcacheClose(t *testing.T) {
+	store := newTestMemcache(t)
+	store.mc_timeout = 10 * time.Millisecond
+	fake := fakeFor(store, "127.0.0.1:11211")
+	if _, err := store.getMC(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if fake.closed != 3 {
+		t.Errorf("got %d closed, want 3", fake.closed)
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,368 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// In process presence store.
+
+/** Handy for single node dev and CI boxes where there's no memcached.
+ * Tokens are spread over a number of shards, each with its own lock,
+ * map and LRU list. A background sweeper drops tokens once they've been
+ * expired for db.ttl_linger, and if a shard gets full the least recently
+ * pinged token is evicted.
+ *
+ * Revoked tokens are kept apart, in a set that is never swept or
+ * evicted, so a revocation isn't forgotten. So are forwarded (rotated)
+ * tokens, which are retired too once their moved record is gone. It
+ * holds up to memory.max_revoked tokens; after that, revocations and
+ * forwards are refused.
+ *
+ * Rosters are kept apart from the tokens, in a map of their own that
+ * is never swept or evicted. There can be up to memory.max_rosters of
+ * them (grant lists included); after that, new ones are refused.
+ */
+
+import (
+	"mozilla.org/util"
+
+	"container/list"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memEntry struct {
+	key string
+	rec record
+}
+
+type memShard struct {
+	sync.Mutex
+	items map[string]*list.Element
+	// front is the most recently pinged, back the least.
+	lru *list.List
+	max int
+}
+
+type memStore struct {
+	shards []*memShard
+	logger *util.HekaLogger
+	// (SIGHUP may change db.ttl_linger.)
+	retention *retention
+	done      chan bool
+	// roster id -> members.
+	rosterLock sync.RWMutex
+	rosters    map[string][][]byte
+	maxRosters int
+	revokeLock sync.RWMutex
+	revoked    map[string]bool
+	maxRevoked int
+}
+
+func newMemory(config util.JsMap, logger *util.HekaLogger) (*memStore, error) {
+	shardCount, err := strconv.ParseInt(util.MzGet(config, "memory.shards", "32"), 0, 0)
+	if err != nil || shardCount < 1 {
+		return nil, StorageError{"Invalid memory.shards"}
+	}
+	maxSize, err := strconv.ParseInt(util.MzGet(config, "memory.max_size", "1000000"), 0, 0)
+	if err != nil || maxSize < 1 {
+		return nil, StorageError{"Invalid memory.max_size"}
+	}
+	maxRosters, err := strconv.ParseInt(util.MzGet(config, "memory.max_rosters", "100000"), 0, 0)
+	if err != nil || maxRosters < 1 {
+		return nil, StorageError{"Invalid memory.max_rosters"}
+	}
+	maxRevoked, err := strconv.ParseInt(util.MzGet(config, "memory.max_revoked", "1000000"), 0, 0)
+	if err != nil || maxRevoked < 1 {
+		return nil, StorageError{"Invalid memory.max_revoked"}
+	}
+	sweep, err := time.ParseDuration(util.MzGet(config, "memory.sweep_interval", "1m"))
+	if err != nil || sweep <= 0 {
+		return nil, StorageError{"Invalid memory.sweep_interval"}
+	}
+
+	// Spread the size limit over the shards, rounding up so we never
+	// hold fewer than memory.max_size tokens.
+	perShard := int((maxSize + shardCount - 1) / shardCount)
+	store := &memStore{
+		shards:     make([]*memShard, shardCount),
+		logger:     logger,
+		retention:  newRetention(config, logger),
+		done:       make(chan bool),
+		rosters:    make(map[string][][]byte),
+		maxRosters: int(maxRosters),
+		revoked:    make(map[string]bool),
+		maxRevoked: int(maxRevoked),
+	}
+	for i := range store.shards {
+		store.shards[i] = &memShard{
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+			max:   perShard,
+		}
+	}
+	if logger != nil {
+		logger.Info("storage", "Creating new memory store",
+			util.Fields{"shards": strconv.FormatInt(shardCount, 10),
+				"max_size": strconv.FormatInt(maxSize, 10)})
+	}
+	go store.sweeper(sweep)
+	return store, nil
+}
+
+func (self *memStore) shard(key string) *memShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return self.shards[h.Sum32()%uint32(len(self.shards))]
+}
+
+func (self *memStore) RegPing(pk []byte, p *Presence) (err error) {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	if p.Last == 0 {
+		p.Last = time.Now().UTC().Unix()
+	}
+	return self.update(pk, recordOf(p))
+}
+
+func (self *memStore) Drop(pk []byte, keep time.Duration) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.update(pk, record{L: time.Now().UTC().Unix(),
+		T: ttlSeconds(keep),
+		S: statusOffline})
+}
+
+func (self *memStore) Revoke(pk []byte) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	key := string(pk)
+	// (held until it's out of the shard too; see update.)
+	self.revokeLock.Lock()
+	defer self.revokeLock.Unlock()
+	if !self.revoked[key] && len(self.revoked) >= self.maxRevoked {
+		return ErrFull
+	}
+	self.revoked[key] = true
+
+	// nothing else about it matters now.
+	shard := self.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if el, ok := shard.items[key]; ok {
+		shard.evict(el)
+	}
+	return nil
+}
+
+// The moved record says where the token went for grace. It's in the
+// revoked set too, for once that record has been evicted.
+func (self *memStore) Forward(pk, to []byte, grace time.Duration) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	key := string(pk)
+	self.revokeLock.Lock()
+	defer self.revokeLock.Unlock()
+	if !self.revoked[key] && len(self.revoked) >= self.maxRevoked {
+		return ErrFull
+	}
+	err := self.write(pk, record{L: time.Now().UTC().Unix(),
+		T: ttlSeconds(grace),
+		S: statusMoved,
+		M: string(to)}, self.revoked[key])
+	if err != nil {
+		return err
+	}
+	self.revoked[key] = true
+	return nil
+}
+
+// put, unless the token has been revoked or forwarded.
+func (self *memStore) update(pk []byte, rec record) error {
+	self.revokeLock.RLock()
+	defer self.revokeLock.RUnlock()
+	return self.write(pk, rec, self.revoked[string(pk)])
+}
+
+// Store rec for the token, evicting from the shard if it's full. But
+// not if the token's current record refuses it (see record.refuse), or
+// it's revoked.
+func (self *memStore) write(pk []byte, rec record, revoked bool) error {
+	key := string(pk)
+
+	shard := self.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	el, ok := shard.items[key]
+	if ok {
+		// e.g. a moved record, which says whether it's still moved.
+		if err := el.Value.(*memEntry).rec.refuse(time.Now().UTC().Unix()); err != nil {
+			return err
+		}
+	}
+	if revoked {
+		return ErrRevoked
+	}
+	if ok {
+		entry := el.Value.(*memEntry)
+		entry.rec = rec
+		shard.lru.MoveToFront(el)
+		return nil
+	}
+	shard.items[key] = shard.lru.PushFront(&memEntry{key: key, rec: rec})
+	for shard.lru.Len() > shard.max {
+		shard.evict(shard.lru.Back())
+		if self.logger != nil {
+			self.logger.Debug("storage", "Evicted token from full shard", nil)
+		}
+	}
+	return nil
+}
+
+func (self *memStore) CheckPing(pk []byte) (rep *Presence, err error) {
+	if pk == nil {
+		return nil, StorageError{"Invalid Primary Key"}
+	}
+	key := string(pk)
+	now := time.Now().UTC().Unix()
+
+	// A forwarded token's moved record comes first, while there is one.
+	shard := self.shard(key)
+	shard.Lock()
+	el, ok := shard.items[key]
+	if ok && el.Value.(*memEntry).rec.gone(now, self.retention.Linger()) {
+		shard.evict(el)
+		ok = false
+	}
+	var rec record
+	if ok {
+		rec = el.Value.(*memEntry).rec
+	}
+	shard.Unlock()
+	if ok {
+		return rec.check(now)
+	}
+
+	self.revokeLock.RLock()
+	revoked := self.revoked[key]
+	self.revokeLock.RUnlock()
+	if revoked {
+		return nil, ErrRevoked
+	}
+	return nil, ErrNotFound
+}
+
+func (self *memStore) CheckPings(pks [][]byte) (results []Result, err error) {
+	results = make([]Result, len(pks))
+	for i, pk := range pks {
+		results[i].Presence, results[i].Err = self.CheckPing(pk)
+	}
+	return results, nil
+}
+
+func (self *memStore) GetRoster(id []byte) ([][]byte, error) {
+	self.rosterLock.RLock()
+	defer self.rosterLock.RUnlock()
+	members, ok := self.rosters[string(id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([][]byte{}, members...), nil
+}
+
+func (self *memStore) GetRosters(ids [][]byte) ([][][]byte, error) {
+	results := make([][][]byte, len(ids))
+	for i, id := range ids {
+		results[i], _ = self.GetRoster(id)
+	}
+	return results, nil
+}
+
+func (self *memStore) PutRoster(id []byte, members [][]byte) error {
+	if id == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	self.rosterLock.Lock()
+	defer self.rosterLock.Unlock()
+	if _, ok := self.rosters[string(id)]; !ok &&
+		len(self.rosters) >= self.maxRosters {
+		return ErrFull
+	}
+	self.rosters[string(id)] = append([][]byte{}, members...)
+	return nil
+}
+
+func (self *memStore) DelRoster(id []byte) error {
+	self.rosterLock.Lock()
+	defer self.rosterLock.Unlock()
+	delete(self.rosters, string(id))
+	return nil
+}
+
+func (self *memStore) Status() (success bool, err error) {
+	return true, nil
+}
+
+func (self *memStore) Close() {
+	close(self.done)
+}
+
+func (self *memStore) ReloadKeys() []string {
+	return retentionKeys
+}
+
+func (self *memStore) Reload(config util.JsMap) {
+	self.retention.reload(config, self.logger)
+}
+
+// remove an element. Caller must hold the shard lock.
+func (self *memShard) evict(el *list.Element) {
+	delete(self.items, el.Value.(*memEntry).key)
+	self.lru.Remove(el)
+}
+
+// Drop long expired tokens from a shard. TTLs differ from token to
+// token, so the whole shard has to be walked.
+func (self *memShard) sweep(now, linger int64) (count int) {
+	self.Lock()
+	defer self.Unlock()
+	for el := self.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*memEntry).rec.gone(now, linger) {
+			self.evict(el)
+			count++
+		}
+		el = prev
+	}
+	return count
+}
+
+func (self *memStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			now, linger := time.Now().UTC().Unix(), self.retention.Linger()
+			count := 0
+			for _, shard := range self.shards {
+				count += shard.sweep(now, linger)
+			}
+			if count > 0 && self.logger != nil {
+				self.logger.Debug("storage", "Swept expired tokens",
+					util.Fields{"count": strconv.Itoa(count)})
+			}
+		}
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"testing"
+	"time"
+)
+
+func newTestMemory(t *testing.T, config util.JsMap) *memStore {
+	store, err := newMemory(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestMemoryStates(t *testing.T) {
+	store := newTestMemory(t, util.JsMap{})
+	now := time.Now().UTC().Unix()
+	store.update([]byte("present"), record{L: now, T: 900, S: StatusAway})
+	store.update([]byte("expired"), record{L: now - 1000, T: 900})
+	store.update([]byte("gone"), record{L: now - 10000, T: 900})
+	store.update([]byte("offline"), record{L: now, T: 60, S: statusOffline})
+	store.update([]byte("moved"), record{L: now, T: 60, S: statusMoved,
+		M: "new"})
+	store.Revoke([]byte("revoked"))
+
+	tests := []struct {
+		pk  string
+		err error
+	}{
+		{"present", nil},
+		{"expired", ErrExpired},
+		{"gone", ErrNotFound},
+		{"never", ErrNotFound},
+		{"offline", ErrOffline},
+		{"moved", ErrMoved},
+		{"revoked", ErrRevoked},
+	}
+	for _, test := range tests {
+		if _, err := store.CheckPing([]byte(test.pk)); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.pk, err, test.err)
+		}
+	}
+	if p, _ := store.CheckPing([]byte("moved")); string(p.MovedTo) != "new" {
+		t.Errorf("moved: got MovedTo %q", p.MovedTo)
+	}
+}
+
+func TestMemoryKeepsRevocations(t *testing.T) {
+	store := newTestMemory(t, util.JsMap{"memory.shards": "1",
+		"memory.max_size":    "2",
+		"memory.max_revoked": "1"})
+	if err := store.Revoke([]byte("leaked")); err != nil {
+		t.Fatal(err)
+	}
+	// enough pings to push anything else out of the shard.
+	for _, pk := range []string{"a", "b", "c"} {
+		store.RegPing([]byte(pk), &Presence{TTL: time.Minute})
+	}
+	if _, err := store.CheckPing([]byte("leaked")); err != ErrRevoked {
+		t.Errorf("got %v, want ErrRevoked", err)
+	}
+	if err := store.Revoke([]byte("another")); err != ErrFull {
+		t.Errorf("over max_revoked: got %v, want ErrFull", err)
+	}
+	if err := store.Revoke([]byte("leaked")); err != nil {
+		t.Errorf("revoking again: got %v", err)
+	}
+}
+
+func TestMemoryRosterLimit(t *testing.T) {
+	store := newTestMemory(t, util.JsMap{"memory.max_rosters": "1"})
+	members := [][]byte{[]byte("a"), []byte("b")}
+	if err := store.PutRoster([]byte("r1"), members); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutRoster([]byte("r2"), members); err != ErrFull {
+		t.Errorf("new roster: got %v, want ErrFull", err)
+	}
+	// replacing one is fine.
+	if err := store.PutRoster([]byte("r1"), members[:1]); err != nil {
+		t.Errorf("replacing: got %v", err)
+	}
+	store.DelRoster([]byte("r1"))
+	if err := store.PutRoster([]byte("r2"), members); err != nil {
+		t.Errorf("after delete: got %v", err)
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,92 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// What a ping says about a token.
+
+import (
+	"time"
+)
+
+// Status values a token may report.
+const (
+	StatusOnline    = "online"
+	StatusAway      = "away"
+	StatusBusy      = "busy"
+	StatusInvisible = "invisible"
+)
+
+// How precisely a token's owner lets its age be shown, from most to
+// least.
+const (
+	PrecisionExact = "exact"
+	// off by up to a few minutes.
+	PrecisionJitter = "jitter"
+	// just "now", "<5m", "<15m" or "away".
+	PrecisionBucket = "bucket"
+)
+
+// Longest status message we'll store, in bytes.
+const MaxMessageLen = 140
+
+type Presence struct {
+	Last    int64         // when the token last pinged (UTC seconds)
+	TTL     time.Duration // how long that ping keeps it present
+	Status  string
+	Message string
+	MovedTo []byte // the token that replaced this one, if any
+	// how precisely its age may be shown ("" is PrecisionExact).
+	Precision string
+}
+
+// Is this one of the status values we know about?
+func ValidStatus(status string) bool {
+	switch status {
+	case StatusOnline, StatusAway, StatusBusy, StatusInvisible:
+		return true
+	}
+	return false
+}
+
+// Is this one of the precisions we know about?
+func ValidPrecision(precision string) bool {
+	switch precision {
+	case PrecisionExact, PrecisionJitter, PrecisionBucket:
+		return true
+	}
+	return false
+}
+
+// Convert to the (compact) form we actually store.
+func recordOf(p *Presence) record {
+	rec := record{L: p.Last, T: ttlSeconds(p.TTL), M: p.Message}
+	// don't waste space on the default.
+	if p.Status != StatusOnline {
+		rec.S = p.Status
+	}
+	if p.Precision != PrecisionExact {
+		rec.P = p.Precision
+	}
+	return rec
+}
+
+func (self record) presence() *Presence {
+	p := &Presence{Last: self.L,
+		TTL:       time.Duration(self.T) * time.Second,
+		Status:    self.S,
+		Message:   self.M,
+		Precision: self.P}
+	if p.Status == "" {
+		p.Status = StatusOnline
+	}
+	if p.Status == statusMoved {
+		p.MovedTo = []byte(self.M)
+		p.Message = ""
+	}
+	return p
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,276 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// In process pub/sub of presence changes.
+
+/** Publishing(store, broker) wraps a Storage so that every ping, drop,
+ * revoke and forward that goes through it is also handed to the Broker,
+ * which passes it on to whoever subscribed to that token.
+ *
+ * The broker only keeps state for tokens someone is watching: the last
+ * ping it saw, and a timer to say when that ping expires. Tokens nobody
+ * watches cost a map lookup per ping.
+ *
+ * This is per process. Pings handled by another node won't show up
+ * here, so run a single node (or sticky clients) if that matters.
+ *
+ * Each subscription has a small buffer ("pubsub.buffer"). A subscriber
+ * that falls that far behind is cut off (its channel is closed) rather
+ * than hold everyone else up; it should resubscribe.
+ */
+
+import (
+	"mozilla.org/util"
+
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event kinds.
+const (
+	// wasn't present, now is.
+	EventPresent = "present"
+	// pinged again, same status and message.
+	EventPing = "ping"
+	// pinged again, with a new status or message.
+	EventStatus = "status"
+	// the last ping's TTL ran out.
+	EventExpired = "expired"
+	EventOffline = "offline"
+	EventRevoked = "revoked"
+	// replaced by another token; see Presence.MovedTo.
+	EventMoved = "moved"
+)
+
+type Event struct {
+	Token []byte
+	Kind  string
+	// What the token looks like now (nil for EventRevoked).
+	Presence *Presence
+}
+
+type Subscription struct {
+	// Events for the tokens subscribed to. Closed if the subscriber
+	// falls behind.
+	C      <-chan Event
+	c      chan Event
+	broker *Broker
+	tokens []string
+	closed bool
+}
+
+// Everyone watching a token, and what we last saw of it.
+type watch struct {
+	subs map[*Subscription]bool
+	// the last ping, while it's live.
+	last  *Presence
+	timer *time.Timer
+}
+
+type Broker struct {
+	sync.Mutex
+	logger  *util.HekaLogger
+	buffer  int
+	watched map[string]*watch
+}
+
+func NewBroker(config util.JsMap, logger *util.HekaLogger) *Broker {
+	buffer, err := strconv.ParseInt(util.MzGet(config, "pubsub.buffer", "64"), 0, 0)
+	if err != nil || buffer < 1 {
+		if logger != nil {
+			logger.Error("pubsub", "Invalid pubsub.buffer, using 64",
+				util.Fields{"value": util.MzGet(config, "pubsub.buffer", "")})
+		}
+		buffer = 64
+	}
+	return &Broker{logger: logger,
+		buffer:  int(buffer),
+		watched: make(map[string]*watch)}
+}
+
+// Start watching tokens. Close the Subscription when done.
+func (self *Broker) Subscribe(pks [][]byte) *Subscription {
+	c := make(chan Event, self.buffer)
+	sub := &Subscription{C: c, c: c, broker: self}
+
+	self.Lock()
+	defer self.Unlock()
+	for _, pk := range pks {
+		key := string(pk)
+		w, ok := self.watched[key]
+		if !ok {
+			w = &watch{subs: make(map[*Subscription]bool)}
+			self.watched[key] = w
+		}
+		if !w.subs[sub] {
+			w.subs[sub] = true
+			sub.tokens = append(sub.tokens, key)
+		}
+	}
+	return sub
+}
+
+// Stop watching. Safe to call more than once.
+func (self *Subscription) Close() {
+	self.broker.Lock()
+	defer self.broker.Unlock()
+	self.broker.unsubscribe(self)
+}
+
+// Caller must hold the broker lock.
+func (self *Broker) unsubscribe(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.c)
+	for _, key := range sub.tokens {
+		w, ok := self.watched[key]
+		if !ok {
+			continue
+		}
+		delete(w.subs, sub)
+		if len(w.subs) == 0 {
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			delete(self.watched, key)
+		}
+	}
+}
+
+// Tell the broker about a ping it didn't see go by (e.g. one looked up
+// when a subscriber first connects), so it can say when it expires.
+// Ignored if the broker already knows better.
+func (self *Broker) Seed(pk []byte, p *Presence) {
+	self.Lock()
+	defer self.Unlock()
+	if w, ok := self.watched[string(pk)]; ok && w.last == nil {
+		self.arm(string(pk), w, p)
+	}
+}
+
+// Hand an event to everyone watching the token. A ping is turned into
+// EventPresent, EventPing or EventStatus, depending on what came before.
+func (self *Broker) Publish(ev Event) {
+	key := string(ev.Token)
+
+	self.Lock()
+	defer self.Unlock()
+	w, ok := self.watched[key]
+	if !ok {
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	prev := w.last
+	w.last = nil
+	if ev.Kind == EventPing {
+		switch {
+		case prev == nil:
+			ev.Kind = EventPresent
+		case prev.Status != ev.Presence.Status ||
+			prev.Message != ev.Presence.Message:
+			ev.Kind = EventStatus
+		}
+		self.arm(key, w, ev.Presence)
+	}
+	self.send(w, ev)
+}
+
+// Remember p as the token's last ping and set a timer for when it
+// expires. Caller must hold the broker lock.
+func (self *Broker) arm(key string, w *watch, p *Presence) {
+	w.last = p
+	left := time.Duration(p.Last-time.Now().UTC().Unix())*time.Second + p.TTL
+	w.timer = time.AfterFunc(left, func() {
+		self.Lock()
+		defer self.Unlock()
+		// only if nothing has happened to the token since.
+		if cur, ok := self.watched[key]; ok && cur == w && w.last == p {
+			w.last = nil
+			w.timer = nil
+			self.send(w, Event{Token: []byte(key),
+				Kind:     EventExpired,
+				Presence: p})
+		}
+	})
+}
+
+// Caller must hold the broker lock.
+func (self *Broker) send(w *watch, ev Event) {
+	for sub := range w.subs {
+		select {
+		case sub.c <- ev:
+		default:
+			if self.logger != nil {
+				self.logger.Warn("pubsub", "Dropping slow subscriber",
+					util.Fields{"tokens": strconv.Itoa(len(sub.tokens))})
+			}
+			self.unsubscribe(sub)
+		}
+	}
+}
+
+// A Storage that publishes what happens to it.
+type pubStore struct {
+	Storage
+	broker *Broker
+}
+
+// Wrap store so changes are published to broker.
+func Publishing(store Storage, broker *Broker) Storage {
+	return &pubStore{Storage: store, broker: broker}
+}
+
+func (self *pubStore) RegPing(pk []byte, p *Presence) error {
+	if err := self.Storage.RegPing(pk, p); err != nil {
+		return err
+	}
+	// a copy, the caller may reuse p.
+	pub := *p
+	self.broker.Publish(Event{Token: pk, Kind: EventPing, Presence: &pub})
+	return nil
+}
+
+func (self *pubStore) Drop(pk []byte, keep time.Duration) error {
+	if err := self.Storage.Drop(pk, keep); err != nil {
+		return err
+	}
+	self.broker.Publish(Event{Token: pk,
+		Kind: EventOffline,
+		Presence: &Presence{Last: time.Now().UTC().Unix(),
+			TTL:    keep,
+			Status: statusOffline}})
+	return nil
+}
+
+func (self *pubStore) Revoke(pk []byte) error {
+	if err := self.Storage.Revoke(pk); err != nil {
+		return err
+	}
+	self.broker.Publish(Event{Token: pk, Kind: EventRevoked})
+	return nil
+}
+
+func (self *pubStore) Forward(pk, to []byte, grace time.Duration) error {
+	if err := self.Storage.Forward(pk, to, grace); err != nil {
+		return err
+	}
+	self.broker.Publish(Event{Token: pk,
+		Kind: EventMoved,
+		Presence: &Presence{Last: time.Now().UTC().Unix(),
+			TTL:     grace,
+			Status:  statusMoved,
+			MovedTo: to}})
+	return nil
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
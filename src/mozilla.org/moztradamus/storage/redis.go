@@ -0,0 +1,608 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// Redis presence store.
+
+/** Last ping times are kept in sorted sets, one per shard, with the
+ * token as the member and the UTC second of the ping as the score.
+ * Since every ping can carry its own TTL, a second sorted set per shard
+ * holds when each token expires. CheckPing is a pair of ZSCOREs, expiry
+ * is a periodic ZREMRANGEBYSCORE (once a token has been expired for
+ * db.ttl_linger). Status (";<precision>", unless exact) and message
+ * are a plain key per token that redis expires along with the ping.
+ *
+ * Dropping, revoking or forwarding a token takes it out of the sorted
+ * sets and leaves "offline\n<when>", "revoked" or
+ * "moved\n<new token>\n<when>\n<grace>" in its status key instead. The
+ * offline one expires; the others are kept for good.
+ *
+ * Pings, drops and forwards mustn't undo a revocation or forward, so
+ * they WATCH
+ * the status key, check it, and write in a MULTI/EXEC. A revoke in
+ * between fails the EXEC, and the write is tried again.
+ *
+ * A roster is a plain key, "<prefix>r:<id>", holding its members one
+ * per line.
+ */
+
+import (
+	"mozilla.org/util"
+
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type redisStore struct {
+	logger *util.HekaLogger
+	server string
+	prefix string
+	shards int
+	// (SIGHUP may change db.timeout_live and db.ttl_linger.)
+	retention *retention
+	timeout   time.Duration
+	io_limit  time.Duration
+	conns     chan *respConn
+	done      chan bool
+}
+
+func newRedis(config util.JsMap, logger *util.HekaLogger) (*redisStore, error) {
+	poolSize, err := strconv.ParseInt(util.MzGet(config, "redis.pool_size", "10"), 0, 0)
+	if err != nil || poolSize < 1 {
+		return nil, StorageError{"Invalid redis.pool_size"}
+	}
+	shards, err := strconv.ParseInt(util.MzGet(config, "redis.shards", "16"), 0, 0)
+	if err != nil || shards < 1 {
+		return nil, StorageError{"Invalid redis.shards"}
+	}
+	timeout, err := time.ParseDuration(util.MzGet(config, "db.handle_timeout", "5s"))
+	if err != nil {
+		if logger != nil {
+			logger.Error("storage", "Could not parse db.handle_timeout",
+				util.Fields{"err": err.Error()})
+		}
+		timeout = 10 * time.Second
+	}
+	ioLimit, err := time.ParseDuration(util.MzGet(config, "redis.io_timeout", "1s"))
+	if err != nil {
+		return nil, StorageError{"Invalid redis.io_timeout"}
+	}
+	sweep, err := time.ParseDuration(util.MzGet(config, "redis.sweep_interval", "1m"))
+	if err != nil || sweep <= 0 {
+		return nil, StorageError{"Invalid redis.sweep_interval"}
+	}
+
+	store := &redisStore{
+		logger:    logger,
+		server:    no_whitespace.Replace(util.MzGet(config, "redis.server", "127.0.0.1:6379")),
+		prefix:    util.MzGet(config, "redis.prefix", "moz:"),
+		shards:    int(shards),
+		retention: newRetention(config, logger),
+		timeout:   timeout,
+		io_limit:  ioLimit,
+		conns:     make(chan *respConn, poolSize),
+		done:      make(chan bool),
+	}
+	// Connections are dialed lazily, an empty slot is a nil.
+	for i := 0; i < int(poolSize); i++ {
+		store.conns <- nil
+	}
+	if logger != nil {
+		logger.Info("storage", "Creating new redis handler",
+			util.Fields{"server": store.server})
+	}
+	go store.sweeper(sweep)
+	return store, nil
+}
+
+func (self *redisStore) shard(pk []byte) int {
+	h := fnv.New32a()
+	h.Write(pk)
+	return int(h.Sum32() % uint32(self.shards))
+}
+
+// Last ping times live in "<prefix>p:<shard>", expiry times in
+// "<prefix>x:<shard>". Status is in "<prefix>s:<token>".
+func (self *redisStore) key(kind string, shard int) string {
+	return self.prefix + kind + ":" + strconv.Itoa(shard)
+}
+
+func (self *redisStore) getConn() (*respConn, error) {
+	select {
+	case conn := <-self.conns:
+		if conn != nil {
+			return conn, nil
+		}
+		conn, err := dialResp(self.server, self.io_limit)
+		if err != nil {
+			// give the slot back so we can try again later.
+			self.conns <- nil
+			if self.logger != nil {
+				self.logger.Error("storage", "Could not connect to redis",
+					util.Fields{"error": err.Error()})
+			}
+			return nil, err
+		}
+		return conn, nil
+	case <-time.After(self.timeout):
+		if self.logger != nil {
+			self.logger.Error("storage", "Connection Pool Saturated!", nil)
+		} else {
+			log.Printf("Connection Pool Saturated!")
+		}
+		return nil, StorageError{"Connection Pool Saturated"}
+	}
+}
+
+// Return a connection to the pool. A connection that failed may be
+// out of step with the server, so it's dropped and redialed later.
+func (self *redisStore) returnConn(conn *respConn, err error) {
+	if err != nil {
+		if _, ok := err.(respError); !ok {
+			conn.Close()
+			conn = nil
+		}
+	}
+	self.conns <- conn
+}
+
+func (self *redisStore) do(args ...interface{}) (reply interface{}, err error) {
+	conn, err := self.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err = conn.Do(args...)
+	self.returnConn(conn, err)
+	if err != nil && self.logger != nil {
+		self.logger.Error("storage", "Redis command failed",
+			util.Fields{"command": args[0].(string),
+				"error": err.Error()})
+	}
+	return reply, err
+}
+
+// Send several commands in one round trip and collect their replies.
+func (self *redisStore) pipeline(cmds ...[]interface{}) (replies []interface{}, err error) {
+	conn, err := self.getConn()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { self.returnConn(conn, err) }()
+	for _, cmd := range cmds {
+		if err = conn.Send(cmd...); err != nil {
+			return nil, err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies = make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, rerr := conn.Receive()
+		if _, ok := rerr.(respError); ok {
+			// keep reading so the connection stays in step.
+			err = rerr
+			continue
+		}
+		if rerr != nil {
+			// The rest would each wait out io_limit, and the reader is
+			// out of step anyway; returnConn drops the connection.
+			err = rerr
+			break
+		}
+		replies[i] = reply
+	}
+	if err != nil && self.logger != nil {
+		self.logger.Error("storage", "Redis pipeline failed",
+			util.Fields{"error": err.Error()})
+	}
+	return replies, err
+}
+
+func scoreOf(reply interface{}) (score int64, ok bool) {
+	b, ok := reply.([]byte)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func (self *redisStore) statusKey(pk []byte) []byte {
+	return append([]byte(self.prefix+"s:"), pk...)
+}
+
+// "<status>[;<precision>]\n<message>"
+func statusValue(rec record) string {
+	status := rec.S
+	if len(rec.P) > 0 {
+		status += ";" + rec.P
+	}
+	return status + "\n" + rec.M
+}
+
+func (self *redisStore) RegPing(pk []byte, p *Presence) (err error) {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	if p.Last == 0 {
+		p.Last = time.Now().UTC().Unix()
+	}
+	rec := recordOf(p)
+	shard := self.shard(pk)
+	return self.guarded(pk,
+		[]interface{}{"ZADD", self.key("p", shard), rec.L, pk},
+		[]interface{}{"ZADD", self.key("x", shard), rec.L + rec.T, pk},
+		[]interface{}{"SET", self.statusKey(pk), statusValue(rec),
+			"EX", rec.T + self.retention.Linger()})
+}
+
+func (self *redisStore) Drop(pk []byte, keep time.Duration) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.guarded(pk, self.replace(pk,
+		statusOffline+"\n"+strconv.FormatInt(time.Now().UTC().Unix(), 10),
+		"EX", ttlSeconds(keep))...)
+}
+
+func (self *redisStore) Revoke(pk []byte) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	_, err := self.pipeline(self.replace(pk, statusRevoked)...)
+	return err
+}
+
+func (self *redisStore) Forward(pk, to []byte, grace time.Duration) error {
+	if pk == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	return self.guarded(pk, self.replace(pk, fmt.Sprintf("%s\n%s\n%d\n%d",
+		statusMoved, to, time.Now().UTC().Unix(), ttlSeconds(grace)))...)
+}
+
+// The commands to take the token out of the sorted sets and leave
+// status (and any SET options) in its status key instead.
+func (self *redisStore) replace(pk []byte, status string, opts ...interface{}) [][]interface{} {
+	shard := self.shard(pk)
+	return [][]interface{}{
+		{"ZREM", self.key("p", shard), pk},
+		{"ZREM", self.key("x", shard), pk},
+		append([]interface{}{"SET", self.statusKey(pk), status}, opts...)}
+}
+
+// Most times a guarded write is tried before giving up.
+const maxGuardTries = 5
+
+// Run cmds for the token in a MULTI/EXEC, unless its status refuses
+// them (see record.refuse). The status key is WATCHed from before it's
+// read, so if it changes before the EXEC, nothing is written and we
+// look again.
+func (self *redisStore) guarded(pk []byte, cmds ...[]interface{}) (err error) {
+	conn, err := self.getConn()
+	if err != nil {
+		return err
+	}
+	// a failure may leave the connection WATCHing, or out of step.
+	var connErr error
+	defer func() {
+		if connErr != nil {
+			conn.Close()
+			conn = nil
+			if self.logger != nil {
+				self.logger.Error("storage", "Redis guarded write failed",
+					util.Fields{"error": connErr.Error()})
+			}
+		}
+		self.conns <- conn
+	}()
+	key := self.statusKey(pk)
+	for try := 0; try < maxGuardTries; try++ {
+		if _, connErr = conn.Do("WATCH", key); connErr != nil {
+			return connErr
+		}
+		var reply interface{}
+		if reply, connErr = conn.Do("GET", key); connErr != nil {
+			return connErr
+		}
+		status, _ := reply.([]byte)
+		cur, _ := markerRecord(status)
+		if err = cur.refuse(time.Now().UTC().Unix()); err != nil {
+			_, connErr = conn.Do("UNWATCH")
+			return err
+		}
+		var done bool
+		if done, connErr = transact(conn, cmds); connErr != nil || done {
+			return connErr
+		}
+	}
+	return StorageError{"Too many concurrent writes"}
+}
+
+// Send cmds as one MULTI/EXEC. Returns false if the EXEC was called off
+// because a WATCHed key changed.
+func transact(conn *respConn, cmds [][]interface{}) (done bool, err error) {
+	conn.Send("MULTI")
+	for _, cmd := range cmds {
+		conn.Send(cmd...)
+	}
+	if err = conn.Send("EXEC"); err != nil {
+		return false, err
+	}
+	if err = conn.Flush(); err != nil {
+		return false, err
+	}
+	// MULTI's OK, a QUEUED per command, then EXEC's replies.
+	var reply interface{}
+	for i := 0; i < len(cmds)+2; i++ {
+		r, rerr := conn.Receive()
+		if _, ok := rerr.(respError); ok {
+			// keep reading so the connection stays in step.
+			err = rerr
+			continue
+		}
+		if rerr != nil {
+			return false, rerr
+		}
+		reply = r
+	}
+	if err != nil {
+		return false, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok {
+		// (a null reply)
+		return false, nil
+	}
+	for _, r := range replies {
+		if rerr, ok := r.(respError); ok {
+			return false, rerr
+		}
+	}
+	return true, nil
+}
+
+func (self *redisStore) CheckPing(pk []byte) (rep *Presence, err error) {
+	if pk == nil {
+		return nil, StorageError{"Invalid Primary Key"}
+	}
+	shard := self.shard(pk)
+	replies, err := self.pipeline(
+		[]interface{}{"ZSCORE", self.key("p", shard), pk},
+		[]interface{}{"ZSCORE", self.key("x", shard), pk},
+		[]interface{}{"GET", self.statusKey(pk)})
+	if err != nil {
+		return nil, err
+	}
+	return self.result(replies, time.Now().UTC().Unix())
+}
+
+// The record for a status key that holds an offline, revoked or moved
+// marker, if it does.
+func markerRecord(status []byte) (rec record, ok bool) {
+	parts := strings.Split(string(status), "\n")
+	switch parts[0] {
+	case statusRevoked:
+	case statusOffline:
+		if len(parts) > 1 {
+			rec.L, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+	case statusMoved:
+		// (one that doesn't parse reads as long since moved.)
+		if len(parts) > 3 {
+			rec.M = parts[1]
+			rec.L, _ = strconv.ParseInt(parts[2], 10, 64)
+			rec.T, _ = strconv.ParseInt(parts[3], 10, 64)
+		}
+	default:
+		return rec, false
+	}
+	rec.S = parts[0]
+	return rec, true
+}
+
+// Make sense of the ZSCORE, ZSCORE, GET replies for a token.
+func (self *redisStore) result(replies []interface{}, now int64) (*Presence, error) {
+	status, _ := replies[2].([]byte)
+	if rec, ok := markerRecord(status); ok {
+		return rec.check(now)
+	}
+	parts := strings.SplitN(string(status), "\n", 2)
+	last, ok := scoreOf(replies[0])
+	expires, xok := scoreOf(replies[1])
+	// The sweeper may not have gotten to it yet.
+	if !ok || !xok || expires+self.retention.Linger() <= now {
+		return nil, ErrNotFound
+	}
+	rec := record{L: last, T: expires - last}
+	if semi := strings.Index(parts[0], ";"); semi >= 0 {
+		rec.S, rec.P = parts[0][:semi], parts[0][semi+1:]
+	} else {
+		rec.S = parts[0]
+	}
+	if len(parts) > 1 {
+		rec.M = parts[1]
+	}
+	return rec.check(now)
+}
+
+// Look the tokens up, a pipeline per batch.
+func (self *redisStore) CheckPings(pks [][]byte) (results []Result, err error) {
+	results = make([]Result, len(pks))
+	for start := 0; start < len(pks); start += batchSize {
+		end := start + batchSize
+		if end > len(pks) {
+			end = len(pks)
+		}
+		cmds := make([][]interface{}, 0, 3*(end-start))
+		for _, pk := range pks[start:end] {
+			shard := self.shard(pk)
+			cmds = append(cmds,
+				[]interface{}{"ZSCORE", self.key("p", shard), pk},
+				[]interface{}{"ZSCORE", self.key("x", shard), pk},
+				[]interface{}{"GET", self.statusKey(pk)})
+		}
+		replies, err := self.pipeline(cmds...)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC().Unix()
+		for i := range pks[start:end] {
+			results[start+i].Presence, results[start+i].Err =
+				self.result(replies[3*i:3*i+3], now)
+		}
+	}
+	return results, nil
+}
+
+// No ping older than this can still be live.
+func (self *redisStore) expiredBefore() int64 {
+	return time.Now().UTC().Unix() - self.retention.Retain()
+}
+
+func (self *redisStore) sweep() (count int64, err error) {
+	now, linger := time.Now().UTC().Unix(), self.retention.Linger()
+	cmds := make([][]interface{}, 0, 2*self.shards)
+	for i := 0; i < self.shards; i++ {
+		cmds = append(cmds,
+			[]interface{}{"ZREMRANGEBYSCORE", self.key("x", i), "-inf",
+				now - linger},
+			[]interface{}{"ZREMRANGEBYSCORE", self.key("p", i), "-inf",
+				self.expiredBefore()})
+	}
+	replies, err := self.pipeline(cmds...)
+	for i := 0; i < len(replies); i += 2 {
+		if n, ok := replies[i].(int64); ok {
+			count += n
+		}
+	}
+	return count, err
+}
+
+func (self *redisStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			count, err := self.sweep()
+			if self.logger == nil {
+				continue
+			}
+			if err != nil {
+				self.logger.Error("storage", "Could not sweep expired tokens",
+					util.Fields{"error": err.Error()})
+			} else if count > 0 {
+				self.logger.Debug("storage", "Swept expired tokens",
+					util.Fields{"count": strconv.FormatInt(count, 10)})
+			}
+		}
+	}
+}
+
+func (self *redisStore) rosterKey(id []byte) []byte {
+	return append([]byte(self.prefix+"r:"), id...)
+}
+
+func (self *redisStore) GetRoster(id []byte) ([][]byte, error) {
+	reply, err := self.do("GET", self.rosterKey(id))
+	if err != nil {
+		return nil, err
+	}
+	joined, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return splitMembers(string(joined)), nil
+}
+
+// An MGET per batch.
+func (self *redisStore) GetRosters(ids [][]byte) ([][][]byte, error) {
+	results := make([][][]byte, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := make([]interface{}, 0, end-start+1)
+		args = append(args, "MGET")
+		for _, id := range ids[start:end] {
+			args = append(args, self.rosterKey(id))
+		}
+		reply, err := self.do(args...)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != end-start {
+			return nil, StorageError{"Invalid value returned"}
+		}
+		for i, value := range values {
+			if joined, ok := value.([]byte); ok {
+				results[start+i] = splitMembers(string(joined))
+			}
+		}
+	}
+	return results, nil
+}
+
+func (self *redisStore) PutRoster(id []byte, members [][]byte) error {
+	if id == nil {
+		return StorageError{"Invalid Primary Key"}
+	}
+	_, err := self.do("SET", self.rosterKey(id), joinMembers(members))
+	return err
+}
+
+func (self *redisStore) DelRoster(id []byte) error {
+	_, err := self.do("DEL", self.rosterKey(id))
+	return err
+}
+
+func (self *redisStore) Status() (success bool, err error) {
+	reply, err := self.do("PING")
+	if err != nil {
+		return false, err
+	}
+	if pong, ok := reply.(string); !ok || strings.ToUpper(pong) != "PONG" {
+		return false, StorageError{"Invalid value returned"}
+	}
+	return true, nil
+}
+
+func (self *redisStore) Close() {
+	close(self.done)
+	for i := 0; i < cap(self.conns); i++ {
+		select {
+		case conn := <-self.conns:
+			if conn != nil {
+				conn.Close()
+			}
+		case <-time.After(self.timeout):
+			return
+		}
+	}
+}
+
+func (self *redisStore) ReloadKeys() []string {
+	return retentionKeys
+}
+
+func (self *redisStore) Reload(config util.JsMap) {
+	self.retention.reload(config, self.logger)
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
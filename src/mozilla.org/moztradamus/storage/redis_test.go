@@ -0,0 +1,252 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Just enough of a redis server for redisStore: strings (with EX),
+// sorted sets, and WATCH/MULTI/EXEC.
+type fakeRedis struct {
+	sync.Mutex
+	addr  string
+	strs  map[string]fakeString
+	zsets map[string]map[string]float64
+	// bumped on every write to a key, for WATCH.
+	versions map[string]int
+}
+
+type fakeString struct {
+	val     string
+	expires time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	fake := &fakeRedis{addr: ln.Addr().String(),
+		strs:     make(map[string]fakeString),
+		zsets:    make(map[string]map[string]float64),
+		versions: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+// A redisStore talking to a fake of its own.
+func newTestRedis(t *testing.T) *redisStore {
+	store, err := newRedis(util.JsMap{"redis.server": newFakeRedis(t).addr},
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func (self *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := &respConn{r: bufio.NewReader(conn)}
+	w := bufio.NewWriter(conn)
+	var watched map[string]int
+	var queued [][]string
+	multi := false
+	for {
+		req, err := r.readReply()
+		if err != nil {
+			return
+		}
+		parts, _ := req.([]interface{})
+		args := make([]string, len(parts))
+		for i, part := range parts {
+			b, _ := part.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+		self.Lock()
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "WATCH":
+			if watched == nil {
+				watched = make(map[string]int)
+			}
+			for _, key := range args[1:] {
+				watched[key] = self.versions[key]
+			}
+			w.WriteString("+OK\r\n")
+		case cmd == "UNWATCH":
+			watched = nil
+			w.WriteString("+OK\r\n")
+		case cmd == "MULTI":
+			multi = true
+			w.WriteString("+OK\r\n")
+		case cmd == "EXEC":
+			changed := false
+			for key, version := range watched {
+				changed = changed || self.versions[key] != version
+			}
+			if changed {
+				w.WriteString("*-1\r\n")
+			} else {
+				fmt.Fprintf(w, "*%d\r\n", len(queued))
+				for _, q := range queued {
+					w.WriteString(self.run(q))
+				}
+			}
+			watched, queued, multi = nil, nil, false
+		case multi:
+			queued = append(queued, args)
+			w.WriteString("+QUEUED\r\n")
+		default:
+			w.WriteString(self.run(args))
+		}
+		self.Unlock()
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respInt(n int) string {
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+func parseScore(s string) float64 {
+	switch s {
+	case "-inf":
+		return math.Inf(-1)
+	case "+inf", "inf":
+		return math.Inf(1)
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// Run a command, and return its reply. Caller holds the lock.
+func (self *fakeRedis) run(args []string) string {
+	now := time.Now()
+	get := func(key string) (string, bool) {
+		s, ok := self.strs[key]
+		if ok && !s.expires.IsZero() && !now.Before(s.expires) {
+			delete(self.strs, key)
+			return "", false
+		}
+		return s.val, ok
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if val, ok := get(args[1]); ok {
+			return respBulk(val)
+		}
+		return "$-1\r\n"
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if val, ok := get(key); ok {
+				reply += respBulk(val)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "SET":
+		s := fakeString{val: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+			secs, _ := strconv.Atoi(args[4])
+			s.expires = now.Add(time.Duration(secs) * time.Second)
+		}
+		self.strs[args[1]] = s
+		self.versions[args[1]]++
+		return "+OK\r\n"
+	case "DEL":
+		count := 0
+		for _, key := range args[1:] {
+			if _, ok := get(key); ok {
+				delete(self.strs, key)
+				count++
+			}
+			self.versions[key]++
+		}
+		return respInt(count)
+	case "ZADD":
+		set, ok := self.zsets[args[1]]
+		if !ok {
+			set = make(map[string]float64)
+			self.zsets[args[1]] = set
+		}
+		_, had := set[args[3]]
+		set[args[3]] = parseScore(args[2])
+		self.versions[args[1]]++
+		if had {
+			return respInt(0)
+		}
+		return respInt(1)
+	case "ZREM":
+		count := 0
+		for _, member := range args[2:] {
+			if _, ok := self.zsets[args[1]][member]; ok {
+				delete(self.zsets[args[1]], member)
+				count++
+			}
+		}
+		self.versions[args[1]]++
+		return respInt(count)
+	case "ZSCORE":
+		if score, ok := self.zsets[args[1]][args[2]]; ok {
+			return respBulk(strconv.FormatFloat(score, 'f', -1, 64))
+		}
+		return "$-1\r\n"
+	case "ZREMRANGEBYSCORE":
+		min, max := parseScore(args[2]), parseScore(args[3])
+		count := 0
+		for member, score := range self.zsets[args[1]] {
+			if score >= min && score <= max {
+				delete(self.zsets[args[1]], member)
+				count++
+			}
+		}
+		self.versions[args[1]]++
+		return respInt(count)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisStatus(t *testing.T) {
+	store := newTestRedis(t)
+	if ok, err := store.Status(); !ok || err != nil {
+		t.Errorf("got (%v, %v)", ok, err)
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,174 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// Minimal RESP (REdis Serialization Protocol) client.
+
+/** Just enough to talk to redis-server (or anything that fakes it):
+ * commands go out as arrays of bulk strings, replies come back as
+ * string, respError, int64, []byte or []interface{} (nil for null).
+ * Send/Flush/Receive allow pipelining several commands.
+ */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type respError string
+
+func (e respError) Error() string {
+	return "RESP: " + string(e)
+}
+
+type respConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	pending int
+}
+
+func dialResp(addr string, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{conn: conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: timeout}, nil
+}
+
+func (self *respConn) Close() error {
+	return self.conn.Close()
+}
+
+// Queue a command. Arguments may be strings, []byte or integers.
+func (self *respConn) Send(args ...interface{}) (err error) {
+	fmt.Fprintf(self.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			return fmt.Errorf("RESP: unsupported argument %T", arg)
+		}
+		fmt.Fprintf(self.w, "$%d\r\n", len(b))
+		self.w.Write(b)
+		if _, err = self.w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	self.pending++
+	return nil
+}
+
+func (self *respConn) Flush() error {
+	if self.timeout > 0 {
+		self.conn.SetWriteDeadline(time.Now().Add(self.timeout))
+	}
+	return self.w.Flush()
+}
+
+// Read the reply for the oldest queued command.
+func (self *respConn) Receive() (reply interface{}, err error) {
+	if self.pending == 0 {
+		return nil, errors.New("RESP: no pending replies")
+	}
+	if self.timeout > 0 {
+		self.conn.SetReadDeadline(time.Now().Add(self.timeout))
+	}
+	reply, err = self.readReply()
+	self.pending--
+	if e, ok := reply.(respError); ok && err == nil {
+		return nil, e
+	}
+	return reply, err
+}
+
+// Send a single command and wait for its reply.
+func (self *respConn) Do(args ...interface{}) (interface{}, error) {
+	if err := self.Send(args...); err != nil {
+		return nil, err
+	}
+	if err := self.Flush(); err != nil {
+		return nil, err
+	}
+	return self.Receive()
+}
+
+func (self *respConn) readLine() (string, error) {
+	line, err := self.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("RESP: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (self *respConn) readReply() (interface{}, error) {
+	line, err := self.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("RESP: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(self.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = self.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("RESP: unknown reply type " + line[:1])
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		reply interface{}
+		ok    bool
+	}{
+		{"status", "+OK\r\n", "OK", true},
+		{"error", "-ERR wrong type\r\n", respError("ERR wrong type"), true},
+		{"integer", ":42\r\n", int64(42), true},
+		{"negative", ":-1\r\n", int64(-1), true},
+		{"bulk", "$5\r\nhello\r\n", []byte("hello"), true},
+		{"empty bulk", "$0\r\n\r\n", []byte{}, true},
+		{"bulk with CRLF", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), true},
+		{"null bulk", "$-1\r\n", nil, true},
+		{"array", "*3\r\n:1\r\n$1\r\nx\r\n$-1\r\n",
+			[]interface{}{int64(1), []byte("x"), nil}, true},
+		{"nested", "*1\r\n*1\r\n+a\r\n",
+			[]interface{}{[]interface{}{"a"}}, true},
+		{"null array", "*-1\r\n", nil, true},
+		{"no CR", "+OK\n", nil, false},
+		{"empty line", "\r\n", nil, false},
+		{"unknown type", "?\r\n", nil, false},
+		{"bad integer", ":x\r\n", nil, false},
+		{"short bulk", "$5\r\nhi\r\n", nil, false},
+		{"short array", "*2\r\n:1\r\n", nil, false},
+		{"nothing", "", nil, false},
+	}
+	for _, test := range tests {
+		conn := &respConn{r: bufio.NewReader(strings.NewReader(test.input))}
+		reply, err := conn.readReply()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(reply, test.reply) {
+			t.Errorf("%s: got %#v, want %#v", test.name, reply, test.reply)
+		}
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
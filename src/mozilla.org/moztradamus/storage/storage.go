@@ -4,27 +4,21 @@
 
 package storage
 
-// thin memcache wrapper
+// Presence storage front end.
 
-/** This library uses libmemcache (via gomc) to do most of it's work.
- * libmemcache handles key sharding, multiple nodes, node balancing, etc.
+/** The handlers only ever talk to the Storage interface. The actual
+ * work is done by one of the backends, which is picked by the
+ * "db.backend" config value: "memcache" (default), "memory", "redis"
+ * or "disk".
  */
 
 import (
-	"github.com/ianoshen/gomc"
-
 	"mozilla.org/util"
 
-	"bufio"
 	"encoding/base64"
 	"encoding/hex"
-	"errors"
-	"fmt"
 	"log"
-	"net"
-	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 )
 
@@ -39,104 +33,199 @@ var (
 		"\x0d", "")
 )
 
-type Storage struct {
-	config     util.JsMap
-	mcs        chan gomc.Client
-	logger     *util.HekaLogger
-	mc_timeout time.Duration
-	servers    []string
+// Storage is what a presence backend needs to provide.
+type Storage interface {
+	// Record that the token has just pinged. The store sets p.Last,
+	// unless it's already set (e.g. a ping carried over from another
+	// token); p.TTL is how long the token stays present from then. A
+	// revoked or forwarded token is left as it is, and ErrRevoked or
+	// ErrMoved returned (the check and the write are one step, so a
+	// Revoke or Forward can't be undone by a ping racing it).
+	RegPing(pk []byte, p *Presence) error
+	// Return the token's last ping. Returns ErrNotFound if the token is
+	// unknown, or the last ping and ErrExpired if its TTL has run out.
+	CheckPing(pk []byte) (*Presence, error)
+	// CheckPing a batch of tokens in as few round trips as the backend
+	// allows. Results are in the same order as pks. The error is only
+	// for the batch as a whole (e.g. the backend is down).
+	CheckPings(pks [][]byte) ([]Result, error)
+	// Take the token offline now. CheckPing reports it as ErrOffline
+	// for keep afterwards, then forgets it. ErrRevoked as for RegPing.
+	Drop(pk []byte, keep time.Duration) error
+	// Retire the token for good. CheckPing reports ErrRevoked for it
+	// from now on.
+	Revoke(pk []byte) error
+	// Note that the token has been replaced by to. For grace afterwards
+	// CheckPing reports ErrMoved, with to in the Presence's MovedTo;
+	// after that, ErrRevoked. (A rotated token is retired for good, it
+	// mustn't come back once the grace is over.) ErrRevoked or ErrMoved
+	// as for RegPing.
+	Forward(pk, to []byte, grace time.Duration) error
+	// Return a roster's tokens, in the order they were stored. Returns
+	// ErrNotFound if there's no such roster.
+	GetRoster(id []byte) ([][]byte, error)
+	// GetRoster a batch of rosters. Results are in the same order as
+	// ids, nil for a roster that doesn't exist.
+	GetRosters(ids [][]byte) ([][][]byte, error)
+	// Store (or replace) a roster. Rosters are kept until deleted.
+	PutRoster(id []byte, members [][]byte) error
+	// Forget a roster. Not an error if there isn't one.
+	DelRoster(id []byte) error
+	// Check that the backend is up and usable.
+	Status() (bool, error)
+	// Release any resources held by the backend.
+	Close()
 }
 
-var mcsPoolSize int32
+// One token's answer from CheckPings. Err is nil, ErrExpired,
+// ErrOffline, ErrRevoked, ErrMoved or ErrNotFound, just as for
+// CheckPing.
+type Result struct {
+	Presence *Presence
+	Err      error
+}
 
-// Attempting to use dynamic pools seems to cause all sorts of problems.
-// The first being that the pool channel can't be resized once it's built
-// in New(). The other being that during shutdown, go throws a popdefer
-// phase error that I've not been able to chase the source. Since this doesn't
-// happen for statically set pools, I'm going to go with that for now.
-// var mcsMaxPoolSize int32
+// Most tokens to ask a backend about in one go.
+const batchSize = 1000
 
 // ChannelRecord
 // I am using very short IDs here because these are also stored as part of the GLOB
 // and space matters in MC.
 type record struct {
 	L int64  // Last touched
+	T int64  // TTL (seconds)
+	S string // Status ("" for online)
+	M string // Status message
+	P string // Precision ("" for exact)
 }
 
-type StorageError struct {
-	err string
+// Markers stored in place of a status once a token is dropped, revoked
+// or forwarded. For offline records, T is how long to keep it. A moved
+// record has the new token in M, and T is how long to say so; it's kept
+// for good, as a revocation once T is up.
+const (
+	statusOffline = "offline"
+	statusRevoked = "revoked"
+	statusMoved   = "moved"
+	// not a token at all: a roster, with its members in M.
+	statusRoster = "roster"
+)
+
+func (self record) expired(now int64) bool {
+	return self.L+self.T <= now
 }
 
-func (e StorageError) Error() string {
-	// foo call so that import log doesn't complain
-	_ = log.Flags()
-	return "StorageError: " + e.err
+// How long (seconds, from L) a backend has to hang on to the record.
+// 0 means forever.
+func (self record) keep(linger int64) int64 {
+	switch self.S {
+	case statusRevoked, statusMoved, statusRoster:
+		return 0
+	case statusOffline:
+		return self.T
+	}
+	// a while past the TTL, so we can say it expired.
+	return self.T + linger
 }
 
-// Returns a new slice with the string at position pos removed or
-// an equivilant slice if the pos is not in the bounds of the slice
-func remove(list [][]byte, pos int) (res [][]byte) {
-	if pos < 0 || pos == len(list) {
-		return list
+// Past expired, and past the point of remembering it at all.
+func (self record) gone(now, linger int64) bool {
+	keep := self.keep(linger)
+	return keep > 0 && self.L+keep <= now
+}
+
+// What CheckPing should return for a record it found.
+func (self record) check(now int64) (*Presence, error) {
+	switch self.S {
+	case statusRevoked:
+		return nil, ErrRevoked
+	case statusOffline:
+		return self.presence(), ErrOffline
+	case statusMoved:
+		if self.expired(now) {
+			return nil, ErrRevoked
+		}
+		return self.presence(), ErrMoved
 	}
-	return append(list[:pos], list[pos+1:]...)
+	if self.expired(now) {
+		return self.presence(), ErrExpired
+	}
+	return self.presence(), nil
 }
 
-// Use the AWS system to query for the endpoints to use.
-// (Allows for dynamic endpoint assignments)
-func getElastiCacheEndpoints(configEndpoint string) (string, error) {
-	c, err := net.Dial("tcp", configEndpoint)
-	if err != nil {
-		return "", err
+// Whether a ping, Drop or Forward may replace the record. Not once
+// it's revoked or forwarded.
+func (self record) refuse(now int64) error {
+	switch self.S {
+	case statusRevoked, statusMoved:
+		_, err := self.check(now)
+		return err
 	}
-	defer c.Close()
+	return nil
+}
 
-	reader, writer := bufio.NewReader(c), bufio.NewWriter(c)
-	writer.Write([]byte("config get cluster\r\n"))
-	writer.Flush()
+// Rosters are stored next to the tokens, under a key no token can have.
+func rosterKey(id []byte) []byte {
+	return append([]byte("roster:"), id...)
+}
 
-	reader.ReadString('\n')
-	reader.ReadString('\n')
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return "", nil
+// Tokens never hold a newline.
+func joinMembers(members [][]byte) string {
+	strs := make([]string, len(members))
+	for i, member := range members {
+		strs[i] = string(member)
 	}
+	return strings.Join(strs, "\n")
+}
 
-	endPoints := strings.Split(line, " ")
-	if len(endPoints) < 1 {
-		return "", errors.New("Elasticache returned no endPoints")
+func splitMembers(joined string) [][]byte {
+	if len(joined) == 0 {
+		return [][]byte{}
 	}
-
-	retEndpoints := make([]string, 0)
-	for _, v := range endPoints {
-		endPoint := strings.Split(v, "|")
-		if len(endPoint) < 3 {
-			continue
-		}
-		retEndpoints = append(retEndpoints, fmt.Sprintf("%s:%s", endPoint[1], strings.TrimSpace(endPoint[2])))
+	strs := strings.Split(joined, "\n")
+	members := make([][]byte, len(strs))
+	for i, str := range strs {
+		members[i] = []byte(str)
 	}
-	return strings.Join(retEndpoints, ","), nil
+	return members
 }
 
-func getElastiCacheEndpointsTimeout(configEndpoint string, seconds int) (string, error) {
-	type strErr struct {
-		ep  string
-		err error
-	}
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64(ttl / time.Second)
+}
 
-	ch := make(chan strErr)
-
-	go func() {
-		ep, err := getElastiCacheEndpoints(configEndpoint)
-		ch <- strErr{ep, err}
-	}()
-	select {
-	case se := <-ch:
-		return se.ep, se.err
-	case <-time.After(time.Duration(seconds) * time.Second):
-		return "", errors.New("Elasticache config timeout")
-	}
+type StorageError struct {
+	err string
+}
 
+var (
+	// Never seen, or gone for longer than db.ttl_linger.
+	ErrNotFound = StorageError{"Not Found"}
+	// Seen, but not pinged within its TTL.
+	ErrExpired = StorageError{"Expired"}
+	// Explicitly taken offline (see Drop).
+	ErrOffline = StorageError{"Offline"}
+	// Retired for good (see Revoke).
+	ErrRevoked = StorageError{"Revoked"}
+	// Replaced by another token (see Forward).
+	ErrMoved = StorageError{"Moved"}
+	// No room for another roster or revocation (memory.max_*).
+	ErrFull = StorageError{"Full"}
+)
+
+func (e StorageError) Error() string {
+	// foo call so that import log doesn't complain
+	_ = log.Flags()
+	return "StorageError: " + e.err
+}
+
+// Returns a new slice with the string at position pos removed or
+// an equivilant slice if the pos is not in the bounds of the slice
+func remove(list [][]byte, pos int) (res [][]byte) {
+	if pos < 0 || pos == len(list) {
+		return list
+	}
+	return append(list[:pos], list[pos+1:]...)
 }
 
 // Convert a user readable UUID string into it's binary equivalent
@@ -166,44 +255,48 @@ func keydecode(key string) []byte {
 	return ret
 }
 
-func New(opts util.JsMap, logger *util.HekaLogger) *Storage {
-	config = opts
-	var ok bool
-	var err error
+// A backend that can pick up some config changes (on SIGHUP) without a
+// restart.
+type reloader interface {
+	// The keys Reload picks up. One ending in "." covers every key
+	// that starts with it.
+	ReloadKeys() []string
+	Reload(config util.JsMap)
+}
 
-	if configEndpoint, ok := config["elasticache.config_endpoint"]; ok {
-		memcacheEndpoint, err := getElastiCacheEndpointsTimeout(configEndpoint.(string), 2)
-		if err == nil {
-			config["memcache.server"] = memcacheEndpoint
-		} else {
-			fmt.Println(err)
-			if logger != nil {
-				logger.Error("storage", "Elastisearch error.",
-					util.Fields{"error": err.Error()})
-			}
-		}
+func reloaderOf(store Storage) (reloader, bool) {
+	if pub, ok := store.(*pubStore); ok {
+		store = pub.Storage
 	}
+	r, ok := store.(reloader)
+	return r, ok
+}
 
-	if _, ok = config["memcache.server"]; !ok {
-		config["memcache.server"] = "127.0.0.1:11211"
+// The config keys store can change without a restart (none, if it
+// can't reload at all).
+func ReloadKeys(store Storage) []string {
+	if r, ok := reloaderOf(store); ok {
+		return r.ReloadKeys()
 	}
+	return nil
+}
 
-	timeout, err := time.ParseDuration(util.MzGet(config, "db.handle_timeout", "5s"))
-	if err != nil {
-		if logger != nil {
-			logger.Error("storage", "Could not parse db.handle_timeout",
-				util.Fields{"err": err.Error()})
-		}
-		timeout = 10 * time.Second
+// Pass a reloaded config on to store. Only the keys in ReloadKeys are
+// looked at.
+func Reload(store Storage, config util.JsMap) {
+	if r, ok := reloaderOf(store); ok {
+		r.Reload(config)
 	}
-	if _, ok = config["memcache.pool_size"]; !ok {
-		config["memcache.pool_size"] = "100"
-	}
-	if config["memcache.pool_size"], err =
-		strconv.ParseInt(config["memcache.pool_size"].(string), 0, 0); err != nil {
-		config["memcache.pool_size"] = 100
+}
+
+// Create the presence store selected by "db.backend".
+func New(opts util.JsMap, logger *util.HekaLogger) (Storage, error) {
+	config = opts
+	var ok bool
+
+	if _, ok = config["db.backend"]; !ok {
+		config["db.backend"] = "memcache"
 	}
-	poolSize := int(config["memcache.pool_size"].(int64))
 	if _, ok = config["db.timeout_live"]; !ok {
 		config["db.timeout_live"] = "259200"
 	}
@@ -224,262 +317,30 @@ func New(opts util.JsMap, logger *util.HekaLogger) *Storage {
 	if _, ok = config["shard.prefix"]; !ok {
 		config["shard.prefix"] = "_h-"
 	}
-	/*
-		i, err := strconv.ParseInt(util.MzGet(config,
-			"memcache.max_pool_size", "400"), 0, 10)
-		if err != nil {
-			if logger != nil {
-				logger.Error("storage", "Could not parse memcache.max_pool_size",
-					util.Fields{"error": err.Error()})
-			}
-			mcsMaxPoolSize = 400
-		}
-		mcsMaxPoolSize = int32(i)
-	*/
 
+	backend := strings.ToLower(strings.TrimSpace(config["db.backend"].(string)))
 	if logger != nil {
-		logger.Info("storage", "Creating new gomc handler", nil)
-	}
-	// do NOT include any spaces
-	servers := strings.Split(
-		no_whitespace.Replace(config["memcache.server"].(string)),
-		",")
-
-	mcs := make(chan gomc.Client, poolSize)
-	for i := 0; i < poolSize; i++ {
-		mcs <- newMC(servers, config, logger)
+		logger.Info("storage", "Using presence backend",
+			util.Fields{"backend": backend})
 	}
-
-	return &Storage{
-		mcs:        mcs,
-		config:     config,
-		logger:     logger,
-		mc_timeout: timeout,
-		servers:    servers,
-	}
-}
-
-// Generate a new Memcache Client
-func newMC(servers []string, config util.JsMap, logger *util.HekaLogger) (mc gomc.Client) {
+	var store Storage
 	var err error
-	/*	if mcsPoolSize >= mcsMaxPoolSize {
-			return nil
-		}
-	*/
-	mc, err = gomc.NewClient(servers, 1, gomc.ENCODING_GOB)
-	if err != nil {
-		logger.Critical("storage", "CRITICAL HIT!",
-			util.Fields{"error": err.Error()})
-	}
-	// internally hash key using MD5 (for key distribution)
-	mc.SetBehavior(gomc.BEHAVIOR_KETAMA_HASH, 1)
-	// Use the binary protocol, which allows us faster data xfer
-	// and better data storage (can use full UTF-8 char space)
-	mc.SetBehavior(gomc.BEHAVIOR_BINARY_PROTOCOL, 1)
-	//mc.SetBehavior(gomc.BEHAVIOR_NO_BLOCK, 1)
-	// NOTE! do NOT set BEHAVIOR_NOREPLY + Binary. This will cause
-	// libmemcache to drop into an infinite loop.
-	if v, ok := config["memcache.recv_timeout"]; ok {
-		d, err := time.ParseDuration(v.(string))
-		if err == nil {
-			mc.SetBehavior(gomc.BEHAVIOR_SND_TIMEOUT,
-				uint64(d.Nanoseconds()*1000))
-		}
-	}
-	if v, ok := config["memcache.send_timeout"]; ok {
-		d, err := time.ParseDuration(v.(string))
-		if err == nil {
-			mc.SetBehavior(gomc.BEHAVIOR_RCV_TIMEOUT,
-				uint64(d.Nanoseconds()*1000))
-		}
-	}
-	if v, ok := config["memcache.poll_timeout"]; ok {
-		d, err := time.ParseDuration(v.(string))
-		if err == nil {
-			mc.SetBehavior(gomc.BEHAVIOR_POLL_TIMEOUT,
-				uint64(d.Nanoseconds()*1000))
-		}
-	}
-	if v, ok := config["memcache.retry_timeout"]; ok {
-		d, err := time.ParseDuration(v.(string))
-		if err == nil {
-			mc.SetBehavior(gomc.BEHAVIOR_RETRY_TIMEOUT,
-				uint64(d.Nanoseconds()*1000))
-		}
-	}
-	atomic.AddInt32(&mcsPoolSize, 1)
-	return mc
-}
-
-func (self *Storage) fetchRec(pk []byte) (result *record, err error) {
-	//fetch a record from Memcache
-	result = &record{}
-	if pk == nil {
-		err = StorageError{"Invalid Primary Key"}
-		return nil, err
+	switch backend {
+	case "memcache":
+		store, err = newMemcache(config, logger)
+	case "memory":
+		store, err = newMemory(config, logger)
+	case "redis":
+		store, err = newRedis(config, logger)
+	case "disk":
+		store, err = newDisk(config, logger)
+	default:
+		err = StorageError{"Unknown db.backend " + backend}
 	}
-
-	defer func() {
-		if err := recover(); err != nil {
-			if self.logger != nil {
-				self.logger.Error("storage",
-					fmt.Sprintf("could not fetch record for %s", pk),
-					util.Fields{"primarykey": keycode(pk),
-						"error": err.(error).Error()})
-			}
-		}
-	}()
-
-	mc, err := self.getMC()
-	defer self.returnMC(mc)
 	if err != nil {
 		return nil, err
 	}
-	//mc.Timeout = time.Second * 10
-	err = mc.Get(keycode(pk), result)
-	if err != nil && strings.Contains("NOT FOUND", err.Error()) {
-		err = nil
-	}
-	if err != nil {
-		if self.logger != nil {
-			self.logger.Error("storage",
-				"Get Failed",
-				util.Fields{"primarykey": hex.EncodeToString(pk),
-					"error": err.Error()})
-		}
-		return nil, err
-	}
-
-	if self.logger != nil {
-		self.logger.Debug("storage",
-			"Fetched",
-			util.Fields{"primarykey": hex.EncodeToString(pk),
-				"result": fmt.Sprintf("last: %d",
-					result.L),
-			})
-	}
-	return result, err
-}
-
-func (self *Storage) storeRec(pk []byte, rec *record) (err error) {
-	if pk == nil {
-		return StorageError{"Invalid Primary Key"}
-	}
-
-	if rec == nil {
-		err =  StorageError{"No Data to Store"}
-		return err
-	}
-
-	rec.L = time.Now().UTC().Unix()
-
-	mc, err := self.getMC()
-	defer self.returnMC(mc)
-	if err != nil {
-		return err
-	}
-
-	err = mc.Set(keycode(pk), rec, 15*time.Minute)
-	if err != nil {
-		if self.logger != nil {
-			self.logger.Error("storage",
-				"Failure to set item",
-				util.Fields{"primarykey": keycode(pk),
-					"error": err.Error()})
-		}
-	}
-	return err
-}
-
-func (self *Storage) RegPing(pk []byte) (err error) {
-    rec := record{L: time.Now().Unix()}
-    log.Printf("Storing rec %q", rec)
-    return self.storeRec(pk, &rec)
-}
-
-func (self *Storage) CheckPing(pk []byte) (rep int64, err error) {
-    log.Printf("Looking for rec %s", pk)
-    if rec, err := self.fetchRec(pk); err == nil {
-        log.Printf("Found rec %q", rec)
-        return rec.L, nil
-    } else {
-        log.Printf("Nope")
-        return 0, err
-    }
-}
-
-func (self *Storage) Close() {
-	//	self.mc.Close()
-}
-func (self *Storage) Status() (success bool, err error) {
-	defer func() {
-		if recv := recover(); recv != nil {
-			success = false
-			err = recv.(error)
-			return
-		}
-	}()
-
-	fake_id := "_fake_id"
-	key := "status_" + fake_id
-	mc, err := self.getMC()
-	defer self.returnMC(mc)
-	if err != nil {
-		return false, err
-	}
-	err = mc.Set("status_"+fake_id, "test", 6*time.Second)
-	if err != nil {
-		return false, err
-	}
-	var val string
-	err = mc.Get(key, &val)
-	if err != nil || val != "test" {
-		return false, errors.New("Invalid value returned")
-	}
-	mc.Delete(key, time.Duration(0))
-	return true, nil
-}
-
-func (self *Storage) returnMC(mc gomc.Client) {
-	if mc != nil {
-		atomic.AddInt32(&mcsPoolSize, 1)
-		self.mcs <- mc
-	}
-}
-
-func (self *Storage) getMC() (gomc.Client, error) {
-	select {
-	case mc := <-self.mcs:
-		if mc == nil {
-			log.Printf("NULL MC!")
-			return nil, StorageError{"Connection Pool Saturated"}
-		}
-		atomic.AddInt32(&mcsPoolSize, -1)
-		return mc, nil
-	case <-time.After(self.mc_timeout):
-		// As noted before, dynamic pool sizing turns out to be deeply
-		// problematic at this time.
-		// TODO: Investigate why go throws the popdefer phase error on
-		// socket shutdown.
-		/*		if mcsPoolSize < mcsMaxPoolSize {
-					if self.logger != nil {
-						self.logger.Warn("storage", "Increasing Pool Size",
-							util.Fields{"poolSize": strconv.FormatInt(int64(mcsPoolSize+1), 10)})
-					}
-					return newMC(self.servers,
-						self.config,
-						self.logger), nil
-				} else {
-		*/
-		if self.logger != nil {
-			self.logger.Error("storage", "Connection Pool Saturated!", nil)
-		} else {
-			log.Printf("Connection Pool Saturated!")
-		}
-		// mc := self.NewMC(self.servers, self.config)
-		return nil, StorageError{"Connection Pool Saturated"}
-		//		}
-	}
+	return store, nil
 }
 
 // o4fs
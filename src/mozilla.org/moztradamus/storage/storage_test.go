@@ -0,0 +1,234 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every backend, fresh and empty.
+func testStores(t *testing.T) map[string]Storage {
+	return map[string]Storage{
+		"memory":   newTestMemory(t, util.JsMap{}),
+		"disk":     replayed(t, nil),
+		"redis":    newTestRedis(t),
+		"memcache": newTestMemcache(t),
+	}
+}
+
+// What each backend says about a token in each state, one at a time
+// and in a batch.
+func TestStates(t *testing.T) {
+	now := time.Now().UTC().Unix()
+	for name, store := range testStores(t) {
+		store.RegPing([]byte("present"), &Presence{TTL: time.Minute,
+			Status: StatusAway, Message: "lunch"})
+		store.RegPing([]byte("expired"), &Presence{Last: now - 120,
+			TTL: time.Minute})
+		store.RegPing([]byte("offline"), &Presence{TTL: time.Minute})
+		store.Drop([]byte("offline"), time.Hour)
+		store.Revoke([]byte("revoked"))
+		store.RegPing([]byte("moved"), &Presence{TTL: time.Minute})
+		store.Forward([]byte("moved"), []byte("new"), time.Hour)
+
+		tests := []struct {
+			pk  string
+			err error
+		}{
+			{"present", nil},
+			{"expired", ErrExpired},
+			{"never", ErrNotFound},
+			{"offline", ErrOffline},
+			{"revoked", ErrRevoked},
+			{"moved", ErrMoved},
+		}
+		pks := make([][]byte, len(tests))
+		for i, test := range tests {
+			pks[i] = []byte(test.pk)
+			if _, err := store.CheckPing(pks[i]); err != test.err {
+				t.Errorf("%s: %s: got %v, want %v", name, test.pk, err,
+					test.err)
+			}
+		}
+		results, err := store.CheckPings(pks)
+		if err != nil || len(results) != len(tests) {
+			t.Fatalf("%s: batch: got %d results, %v", name, len(results),
+				err)
+		}
+		for i, test := range tests {
+			if results[i].Err != test.err {
+				t.Errorf("%s: batch %s: got %v, want %v", name, test.pk,
+					results[i].Err, test.err)
+			}
+		}
+		if p := results[0].Presence; p == nil || p.Status != StatusAway ||
+			p.Message != "lunch" || p.TTL != time.Minute {
+			t.Errorf("%s: present: got %+v", name, p)
+		}
+	}
+}
+
+func TestRevokeThenPing(t *testing.T) {
+	for name, store := range testStores(t) {
+		pk := []byte("leaked")
+		if err := store.RegPing(pk, &Presence{TTL: time.Minute}); err != nil {
+			t.Fatalf("%s: first ping: %v", name, err)
+		}
+		if err := store.Revoke(pk); err != nil {
+			t.Fatalf("%s: revoke: %v", name, err)
+		}
+		if err := store.RegPing(pk, &Presence{TTL: time.Minute}); err != ErrRevoked {
+			t.Errorf("%s: ping: got %v, want ErrRevoked", name, err)
+		}
+		if err := store.Drop(pk, time.Minute); err != ErrRevoked {
+			t.Errorf("%s: drop: got %v, want ErrRevoked", name, err)
+		}
+		if err := store.Forward(pk, []byte("new"), time.Minute); err != ErrRevoked {
+			t.Errorf("%s: forward: got %v, want ErrRevoked", name, err)
+		}
+		if _, err := store.CheckPing(pk); err != ErrRevoked {
+			t.Errorf("%s: got %v, want ErrRevoked", name, err)
+		}
+	}
+}
+
+// Pings racing a revoke mustn't bring the token back.
+func TestRevokeRacingPings(t *testing.T) {
+	for name, store := range testStores(t) {
+		for i := 0; i < 20; i++ {
+			pk := []byte("token" + strconv.Itoa(i))
+			var wg sync.WaitGroup
+			for j := 0; j < 4; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for k := 0; k < 5; k++ {
+						store.RegPing(pk, &Presence{TTL: time.Minute})
+					}
+				}()
+			}
+			if err := store.Revoke(pk); err != nil {
+				t.Fatalf("%s: revoke: %v", name, err)
+			}
+			wg.Wait()
+			if _, err := store.CheckPing(pk); err != ErrRevoked {
+				t.Errorf("%s: %s: got %v, want ErrRevoked", name, pk, err)
+			}
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	for name, store := range testStores(t) {
+		old, gone := []byte("old"), []byte("gone")
+		store.RegPing(old, &Presence{TTL: time.Minute})
+		store.RegPing(gone, &Presence{TTL: time.Minute})
+		if err := store.Forward(old, []byte("new"), time.Hour); err != nil {
+			t.Fatalf("%s: forward: %v", name, err)
+		}
+		// no grace at all: the token is retired straight away.
+		if err := store.Forward(gone, []byte("new"), 0); err != nil {
+			t.Fatalf("%s: forward: %v", name, err)
+		}
+		p, err := store.CheckPing(old)
+		if err != ErrMoved || string(p.MovedTo) != "new" {
+			t.Errorf("%s: got (%+v, %v), want moved to new", name, p, err)
+		}
+		if err := store.RegPing(old, &Presence{TTL: time.Minute}); err != ErrMoved {
+			t.Errorf("%s: ping: got %v, want ErrMoved", name, err)
+		}
+		if err := store.Forward(old, []byte("other"), time.Hour); err != ErrMoved {
+			t.Errorf("%s: forward again: got %v, want ErrMoved", name, err)
+		}
+		if _, err := store.CheckPing(gone); err != ErrRevoked {
+			t.Errorf("%s: after grace: got %v, want ErrRevoked", name, err)
+		}
+		if err := store.RegPing(gone, &Presence{TTL: time.Minute}); err != ErrRevoked {
+			t.Errorf("%s: ping after grace: got %v, want ErrRevoked", name, err)
+		}
+	}
+}
+
+// A ping carried over from another token keeps its time.
+func TestRegPingKeepsLast(t *testing.T) {
+	last := time.Now().UTC().Unix() - 30
+	for name, store := range testStores(t) {
+		pk := []byte("carried")
+		err := store.RegPing(pk, &Presence{Last: last, TTL: time.Minute})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if p, err := store.CheckPing(pk); err != nil || p.Last != last {
+			t.Errorf("%s: got (%+v, %v), want last %d", name, p, err, last)
+		}
+	}
+}
+
+func TestRosters(t *testing.T) {
+	for name, store := range testStores(t) {
+		members := [][]byte{[]byte("a"), []byte("b")}
+		if err := store.PutRoster([]byte("r1"), members); err != nil {
+			t.Fatalf("%s: put: %v", name, err)
+		}
+		got, err := store.GetRoster([]byte("r1"))
+		if err != nil || !reflect.DeepEqual(got, members) {
+			t.Errorf("%s: got (%q, %v)", name, got, err)
+		}
+		// a roster isn't a token.
+		if _, err := store.CheckPing([]byte("r1")); err != ErrNotFound {
+			t.Errorf("%s: roster as a token: got %v", name, err)
+		}
+		rosters, err := store.GetRosters([][]byte{[]byte("none"),
+			[]byte("r1")})
+		if err != nil || len(rosters) != 2 || rosters[0] != nil ||
+			!reflect.DeepEqual(rosters[1], members) {
+			t.Errorf("%s: batch: got (%q, %v)", name, rosters, err)
+		}
+		if err := store.DelRoster([]byte("r1")); err != nil {
+			t.Fatalf("%s: delete: %v", name, err)
+		}
+		if _, err := store.GetRoster([]byte("r1")); err != ErrNotFound {
+			t.Errorf("%s: after delete: got %v", name, err)
+		}
+	}
+}
+
+// A SIGHUP's config gets through the publishing wrapper to every
+// backend.
+func TestReloadRetention(t *testing.T) {
+	for name, store := range testStores(t) {
+		wrapped := Publishing(store, NewBroker(util.JsMap{}, nil))
+		keys := strings.Join(ReloadKeys(wrapped), ",")
+		if !strings.Contains(keys, "db.ttl_linger") {
+			t.Errorf("%s: ReloadKeys got %s", name, keys)
+		}
+		Reload(wrapped, util.JsMap{"db.timeout_live": "100",
+			"db.ttl_linger": "10"})
+		var r *retention
+		switch s := store.(type) {
+		case *memStore:
+			r = s.retention
+		case *diskStore:
+			r = s.retention
+		case *redisStore:
+			r = s.retention
+		case *mcStore:
+			r = s.retention
+		}
+		if r.Linger() != 10 || r.Retain() != 110 {
+			t.Errorf("%s: got %d, %d", name, r.Linger(), r.Retain())
+		}
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
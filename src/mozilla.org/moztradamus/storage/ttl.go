@@ -0,0 +1,138 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+// How long a ping keeps a token present.
+
+/** All values are in seconds, like the other db.timeout_* values.
+ *  db.ttl           - default TTL (900, i.e. 15 minutes)
+ *  db.ttl.<class>   - default TTL for a token class (e.g. db.ttl.away)
+ *  db.ttl_min       - shortest TTL a client may ask for (60)
+ *  db.timeout_live  - longest anything may be kept live (259200)
+ *  db.ttl_linger    - how long a token is reported as expired, rather
+ *                     than not found, once its TTL runs out (3600)
+ *  db.timeout_del   - how long a token that went offline is reported
+ *                     as offline (86400)
+ *  db.ttl_forward   - how long a rotated token keeps pointing at its
+ *                     replacement (604800, a week), before it's
+ *                     reported as revoked
+ */
+
+import (
+	"mozilla.org/util"
+
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type TTLPolicy struct {
+	Default time.Duration
+	Min     time.Duration
+	Max     time.Duration
+	Classes map[string]time.Duration
+	Linger  time.Duration
+	Offline time.Duration
+	Forward time.Duration
+}
+
+func parseSeconds(config util.JsMap, key, def string, logger *util.HekaLogger) time.Duration {
+	val := util.MzGet(config, key, def)
+	secs, err := strconv.ParseInt(val, 0, 64)
+	if err != nil || secs < 1 {
+		if logger != nil {
+			logger.Error("storage", "Could not parse "+key,
+				util.Fields{"value": val})
+		}
+		secs, _ = strconv.ParseInt(def, 0, 64)
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Build the TTL policy from the config. Bad values are logged and
+// replaced with the defaults.
+func NewTTLPolicy(config util.JsMap, logger *util.HekaLogger) *TTLPolicy {
+	policy := &TTLPolicy{
+		Default: parseSeconds(config, "db.ttl", "900", logger),
+		Min:     parseSeconds(config, "db.ttl_min", "60", logger),
+		Max:     parseSeconds(config, "db.timeout_live", "259200", logger),
+		Classes: make(map[string]time.Duration),
+		Linger:  parseSeconds(config, "db.ttl_linger", "3600", logger),
+		Offline: parseSeconds(config, "db.timeout_del", "86400", logger),
+		Forward: parseSeconds(config, "db.ttl_forward", "604800", logger),
+	}
+	for key := range config {
+		if !strings.HasPrefix(key, "db.ttl.") {
+			continue
+		}
+		class := strings.ToLower(strings.TrimPrefix(key, "db.ttl."))
+		policy.Classes[class] = policy.clamp(parseSeconds(config, key,
+			strconv.FormatInt(int64(policy.Default/time.Second), 10),
+			logger))
+	}
+	if policy.Min > policy.Max {
+		policy.Min = policy.Max
+	}
+	policy.Default = policy.clamp(policy.Default)
+	return policy
+}
+
+func (self *TTLPolicy) clamp(ttl time.Duration) time.Duration {
+	if ttl < self.Min {
+		return self.Min
+	}
+	if ttl > self.Max {
+		return self.Max
+	}
+	return ttl
+}
+
+// Return the TTL to use for a ping. requested is what the client asked
+// for (0 for "don't care"), class is the token class ("" for none).
+func (self *TTLPolicy) Effective(class string, requested time.Duration) time.Duration {
+	if requested > 0 {
+		return self.clamp(requested)
+	}
+	if ttl, ok := self.Classes[strings.ToLower(class)]; ok {
+		return ttl
+	}
+	return self.Default
+}
+
+// What a backend needs of the policy to know when to forget a token, in
+// seconds. A SIGHUP can change it while the backend is running.
+type retention struct {
+	live   int64
+	linger int64
+}
+
+// The keys retention is read from.
+var retentionKeys = []string{"db.timeout_live", "db.ttl_linger"}
+
+func newRetention(config util.JsMap, logger *util.HekaLogger) *retention {
+	self := &retention{}
+	self.reload(config, logger)
+	return self
+}
+
+func (self *retention) reload(config util.JsMap, logger *util.HekaLogger) {
+	policy := NewTTLPolicy(config, logger)
+	atomic.StoreInt64(&self.live, ttlSeconds(policy.Max))
+	atomic.StoreInt64(&self.linger, ttlSeconds(policy.Linger))
+}
+
+// How long past its TTL a token is reported as expired.
+func (self *retention) Linger() int64 {
+	return atomic.LoadInt64(&self.linger)
+}
+
+// The longest a ping can matter for: the longest TTL, then the linger.
+func (self *retention) Retain() int64 {
+	return atomic.LoadInt64(&self.live) + self.Linger()
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
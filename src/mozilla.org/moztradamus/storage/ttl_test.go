@@ -0,0 +1,76 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"testing"
+	"time"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	policy := NewTTLPolicy(util.JsMap{"db.ttl": "600",
+		"db.ttl_min":      "30",
+		"db.timeout_live": "3600",
+		"db.ttl.Away":     "1800",
+		"db.ttl.busy":     "99999",
+		"db.ttl.dnd":      "soon"}, nil)
+	tests := []struct {
+		class     string
+		requested time.Duration
+		want      time.Duration
+	}{
+		{"", 0, 10 * time.Minute},
+		{"unknown", 0, 10 * time.Minute},
+		// classes aren't case sensitive.
+		{"away", 0, 30 * time.Minute},
+		{"AWAY", 0, 30 * time.Minute},
+		// a class is held to timeout_live too.
+		{"busy", 0, time.Hour},
+		// a bad class TTL falls back to the default.
+		{"dnd", 0, 10 * time.Minute},
+		// asking wins over the class, within limits.
+		{"away", 2 * time.Minute, 2 * time.Minute},
+		{"", time.Second, 30 * time.Second},
+		{"", 24 * time.Hour, time.Hour},
+	}
+	for _, test := range tests {
+		if got := policy.Effective(test.class, test.requested); got != test.want {
+			t.Errorf("%q, %v: got %v, want %v", test.class, test.requested,
+				got, test.want)
+		}
+	}
+}
+
+func TestTTLPolicyDefaults(t *testing.T) {
+	policy := NewTTLPolicy(util.JsMap{"db.ttl": "-5", "db.ttl_min": "zero"},
+		nil)
+	if policy.Default != 15*time.Minute || policy.Min != time.Minute ||
+		policy.Max != 72*time.Hour || policy.Forward != 7*24*time.Hour {
+		t.Errorf("got %+v", policy)
+	}
+	// a min over the max gives way to it, and so does the default.
+	policy = NewTTLPolicy(util.JsMap{"db.ttl_min": "7200",
+		"db.timeout_live": "3600"}, nil)
+	if policy.Min != time.Hour || policy.Default != time.Hour {
+		t.Errorf("min over max: got %+v", policy)
+	}
+}
+
+func TestRetentionReload(t *testing.T) {
+	r := newRetention(util.JsMap{}, nil)
+	if r.Linger() != 3600 || r.Retain() != 259200+3600 {
+		t.Errorf("defaults: got %d, %d", r.Linger(), r.Retain())
+	}
+	r.reload(util.JsMap{"db.timeout_live": "100", "db.ttl_linger": "10"},
+		nil)
+	if r.Linger() != 10 || r.Retain() != 110 {
+		t.Errorf("reloaded: got %d, %d", r.Linger(), r.Retain())
+	}
+}
+
+// o4fs
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,236 @@
+package moztradamus
+
+// Server-Sent Events stream of presence changes (/1/stream/).
+
+/** The client names its tokens once, and gets an event for each token's
+ * current state, then one whenever a token pings, changes status,
+ * expires, goes offline, is revoked or rotated. Events are named for
+ * what happened (the storage.Event kinds, plus "state" for the first
+ * round and "unknown" for tokens that turn invisible); the data is
+ * JSON, much like a /1/poll/ result.
+ */
+
+import(
+    "mozilla.org/util"
+    "mozilla.org/moztradamus/storage"
+
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// rotated away; see moved_to.
+const stateMoved = "moved"
+
+type streamEvent struct {
+    Token     string `json:"token"`
+    State     string `json:"state"`
+    Age       *int64 `json:"age_seconds"`
+    Freshness string `json:"freshness,omitempty"`
+    Status    string `json:"status,omitempty"`
+    Message   string `json:"message,omitempty"`
+    MovedTo   string `json:"moved_to,omitempty"`
+}
+
+// Stream settings, from stream.keepalive and stream.max_tokens.
+type streamConfig struct {
+    keepalive time.Duration
+    maxTokens int
+}
+
+func newStreamConfig(config util.JsMap, logger *util.HekaLogger) streamConfig {
+    sc := streamConfig{keepalive: 30 * time.Second, maxTokens: 1000}
+    if d, err := time.ParseDuration(util.MzGet(config, "stream.keepalive",
+        "30s")); err == nil && d > 0 {
+        sc.keepalive = d
+    } else {
+        logger.Error("stream", "Invalid stream.keepalive, using 30s", nil)
+    }
+    if n, err := strconv.ParseInt(util.MzGet(config, "stream.max_tokens",
+        "1000"), 0, 0); err == nil && n > 0 {
+        sc.maxTokens = int(n)
+    } else {
+        logger.Error("stream", "Invalid stream.max_tokens, using 1000", nil)
+    }
+    return sc
+}
+
+func writeEvent(resp http.ResponseWriter, name string, data interface{}) error {
+    body, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", name, body)
+    return err
+}
+
+// Turn a published event into what the client sees.
+func streamEventOf(ev storage.Event, now int64) (name string, reply streamEvent) {
+    name = ev.Kind
+    reply.Token = string(ev.Token)
+    p := ev.Presence
+    // going invisible looks like going away, whatever happens after.
+    if p != nil && p.Status == storage.StatusInvisible {
+        return stateUnknown, streamEvent{Token: reply.Token,
+            State: stateUnknown}
+    }
+    if p != nil {
+        age := now - p.Last
+        reply.Age = &age
+    }
+    switch ev.Kind {
+    case storage.EventPresent, storage.EventPing, storage.EventStatus:
+        reply.State = statePresent
+        reply.Status = p.Status
+        reply.Message = p.Message
+    case storage.EventExpired:
+        reply.State = stateExpired
+    case storage.EventOffline:
+        reply.State = stateOffline
+    case storage.EventRevoked:
+        reply.State = stateRevoked
+    case storage.EventMoved:
+        reply.State = stateMoved
+        reply.MovedTo = string(p.MovedTo)
+    }
+    return name, reply
+}
+
+// Subscribe to tokens, and say where each stands right now (as far as
+// v may see).
+func (self *Handler) watch(tokens []string, v *viewer) (*storage.Subscription, []streamEvent) {
+    pks := make([][]byte, len(tokens))
+    for i, token := range tokens {
+        pks[i] = []byte(token)
+    }
+    // Subscribe before looking, so nothing falls in between.
+    sub := self.broker.Subscribe(pks)
+
+    current := make([]streamEvent, len(tokens))
+    states, presences, movedTo := self.lookup(tokens, v)
+    self.seed(pks, states, presences, movedTo)
+    now := time.Now().UTC().Unix()
+    for i, token := range tokens {
+        current[i] = streamEvent{Token: token, State: states[i],
+            MovedTo: movedTo[i]}
+        presence := presences[i]
+        if presence == nil {
+            continue
+        }
+        current[i].Age, current[i].Freshness, _ = self.freshness(
+            ownerOf(token, movedTo[i]), presence, now)
+        if states[i] == statePresent {
+            current[i].Status = presence.Status
+            current[i].Message = presence.Message
+        }
+    }
+    return sub, current
+}
+
+// GET /1/stream/?tokens=<token>,<token>... (or POST the list, as for
+// /0/poll/) and keep the connection open for events.
+func (self *Handler) StreamHandler(resp http.ResponseWriter, req *http.Request) {
+    var items []string
+
+    flusher, ok := resp.(http.Flusher)
+    if !ok {
+        self.jsonErr(resp, "Streaming not supported", http.StatusInternalServerError)
+        return
+    }
+    if !self.allowRequest(resp, req, self.jsonErr) {
+        return
+    }
+    switch req.Method {
+    case "GET":
+        for _, item := range strings.Split(req.FormValue("tokens"), ",") {
+            if item = strings.TrimSpace(item); len(item) > 0 {
+                items = append(items, item)
+            }
+        }
+    case "POST":
+        // held to poll.max_body and poll.max_tokens, as /0/poll/ is.
+        var err error
+        if items, err = self.readPollBody(req); err != nil {
+            aerr := err.(apiError)
+            self.jsonErr(resp, aerr.msg, aerr.status)
+            return
+        }
+    default:
+        self.jsonErr(resp, "", http.StatusMethodNotAllowed)
+        return
+    }
+    if len(items) == 0 {
+        self.jsonErr(resp, "No tokens", http.StatusBadRequest)
+        return
+    }
+    if len(items) > self.stream.maxTokens {
+        self.jsonErr(resp, "Too many tokens", http.StatusRequestEntityTooLarge)
+        return
+    }
+    // as many as a poll for them would cost.
+    if !self.allowPoll(resp, req, len(items), self.jsonErr) {
+        return
+    }
+    tokens, err := canonicalTokens(items)
+    if err != nil {
+        self.jsonErr(resp, err.Error(), http.StatusBadRequest)
+        return
+    }
+    // ?as=<token>&key=<write key> to see tokens granted to it.
+    v, err := self.viewerFrom(req)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    addr, ok := self.openStream(resp, req, self.jsonErr)
+    if !ok {
+        return
+    }
+    defer self.limits.streams.release(addr)
+    resp.Header().Set("Content-Type", "text/event-stream")
+    resp.Header().Set("Cache-Control", "no-cache")
+    resp.WriteHeader(http.StatusOK)
+
+    sub, current := self.watch(tokens, v)
+    defer sub.Close()
+    screen := self.screen(v)
+    for _, reply := range current {
+        if err := writeEvent(resp, "state", reply); err != nil {
+            return
+        }
+    }
+    flusher.Flush()
+
+    keepalive := time.NewTicker(self.stream.keepalive)
+    defer keepalive.Stop()
+    for {
+        select {
+        case ev, ok := <-sub.C:
+            if !ok {
+                // fell behind; the client will reconnect.
+                return
+            }
+            name, reply, ok := screen.pass(ev, time.Now().UTC().Unix())
+            if !ok {
+                continue
+            }
+            if err := writeEvent(resp, name, reply); err != nil {
+                return
+            }
+        case <-keepalive.C:
+            if _, err := io.WriteString(resp, ": keepalive\n\n"); err != nil {
+                return
+            }
+        case <-req.Context().Done():
+            return
+        case <-self.closing:
+            return
+        }
+        flusher.Flush()
+    }
+}
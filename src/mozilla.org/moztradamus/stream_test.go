@@ -0,0 +1,113 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+
+    "bufio"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// Read the next event off a stream, skipping keepalives.
+func nextEvent(t *testing.T, r *bufio.Reader) (string, streamEvent) {
+    var name string
+    var data streamEvent
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            t.Fatalf("reading stream: %v", err)
+        }
+        line = strings.TrimRight(line, "\n")
+        switch {
+        case strings.HasPrefix(line, "event: "):
+            name = strings.TrimPrefix(line, "event: ")
+        case strings.HasPrefix(line, "data: "):
+            if err := json.Unmarshal([]byte(strings.TrimPrefix(line,
+                "data: ")), &data); err != nil {
+                t.Fatalf("%s: %s", err, line)
+            }
+        case len(line) == 0 && len(name) > 0:
+            return name, data
+        }
+    }
+}
+
+func TestStream(t *testing.T) {
+    h := testHandler(t, nil)
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{"status":"away"}`, &ping)
+    other, _ := h.keys.mint()
+    auth := `{"token":"` + ping.Token + `","key":"` + ping.Key + `"`
+
+    server := httptest.NewServer(http.HandlerFunc(h.StreamHandler))
+    defer server.Close()
+    resp, err := http.Get(server.URL + "/1/stream/?tokens=" + ping.Token +
+        "," + other)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // (before server.Close, which waits for the stream.)
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK ||
+        resp.Header.Get("Content-Type") != "text/event-stream" {
+        t.Fatalf("got %d, %s", resp.StatusCode,
+            resp.Header.Get("Content-Type"))
+    }
+    r := bufio.NewReader(resp.Body)
+    states := map[string]string{}
+    for i := 0; i < 2; i++ {
+        name, ev := nextEvent(t, r)
+        if name != "state" {
+            t.Fatalf("got %q, want a state event", name)
+        }
+        states[ev.Token] = ev.State
+    }
+    if states[ping.Token] != statePresent || states[other] != stateUnknown {
+        t.Errorf("first states: got %v", states)
+    }
+
+    tests := []struct {
+        handler http.HandlerFunc
+        body    string
+        event   string
+        state   string
+    }{
+        {h.V1PingHandler, auth + `,"status":"away"}`, "ping", statePresent},
+        {h.V1PingHandler, auth + `,"status":"busy"}`, "status", statePresent},
+        {h.V1OfflineHandler, auth + `}`, "offline", stateOffline},
+        {h.V1RevokeHandler, auth + `}`, "revoked", stateRevoked},
+    }
+    for _, test := range tests {
+        if code := call(t, test.handler, test.body, nil); code != http.StatusOK {
+            t.Fatalf("%s: got %d", test.event, code)
+        }
+        name, ev := nextEvent(t, r)
+        if name != test.event || ev.Token != ping.Token ||
+            ev.State != test.state {
+            t.Errorf("got %q %+v, want %q (%s)", name, ev, test.event,
+                test.state)
+        }
+    }
+}
+
+func TestStreamErrors(t *testing.T) {
+    h := testHandler(t, util.JsMap{"stream.max_tokens": "1"})
+    a, _ := h.keys.mint()
+    b, _ := h.keys.mint()
+    tests := []struct {
+        tokens string
+        status int
+    }{
+        {"", http.StatusBadRequest},
+        {a + "," + b, http.StatusRequestEntityTooLarge},
+        {"not*base64", http.StatusBadRequest},
+    }
+    for _, test := range tests {
+        if code := openTestStream(h, test.tokens); code != test.status {
+            t.Errorf("%q: got %d, want %d", test.tokens, code, test.status)
+        }
+    }
+}
@@ -0,0 +1,277 @@
+package moztradamus
+
+// Presence IDs and their write keys.
+
+/** A token is really two things: the public presence ID, which gets
+ * shared with friends so they can poll it, and a secret write key, which
+ * only the owner has and which is needed to ping.
+ *
+ * Presence IDs are signed, so we can tell the ones we issued from ones a
+ * client made up:
+ *
+ *   random ID (16) | issued, UTC seconds (4) | key ID length (1) |
+ *   key ID | HMAC-SHA256 of all that, truncated (16)
+ *
+ * The write key is another HMAC of the presence ID under the same key,
+ * so there's nothing to store.
+ *
+ * Tokens are unpadded URL safe base64, so they can go in a path or a
+ * query as is. Older tokens were standard base64 ("+", "/" and "="
+ * padding); those are still accepted, and turned into the new form.
+ *
+ * Keys come from "token.keys", a list of "<key id>:<secret>" pairs, and
+ * new tokens are signed with "token.key_id" (default: the first listed).
+ * To rotate, add a new key, make it the token.key_id, and drop the old
+ * one once its tokens no longer matter. Every node needs the same keys.
+ * A plain "token.secret" is taken as key "0".
+ *
+ * The server won't start without a key. For a dev box,
+ * "token.dev_random_key = true" makes one up instead; tokens then die
+ * with the process, and no other node will take them.
+ */
+
+import(
+    "mozilla.org/util"
+
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    tokenIDLen = 16
+    // How much of the HMAC to use for signatures and write keys.
+    macLen = 16
+    // How far in the future an issue time may be (clock skew).
+    tokenSkew = 5 * 60
+    // Longest a token can be: ID, time, 255 byte key ID, MAC; base64'd
+    // (with padding, for old tokens).
+    maxTokenLen = (tokenIDLen + 4 + 1 + 255 + macLen + 2) / 3 * 4
+)
+
+var (
+    errMalformedToken = apiError{"Malformed token", http.StatusBadRequest}
+    errForgedToken    = apiError{"Invalid token signature", http.StatusForbidden}
+)
+
+type tokenKeys struct {
+    keys    map[string][]byte
+    current string
+}
+
+func newTokenKeys(config util.JsMap, logger *util.HekaLogger) (*tokenKeys, error) {
+    self := &tokenKeys{keys: make(map[string][]byte)}
+
+    for _, pair := range strings.Split(util.MzGet(config, "token.keys", ""), ",") {
+        pair = strings.TrimSpace(pair)
+        if len(pair) == 0 {
+            continue
+        }
+        kv := strings.SplitN(pair, ":", 2)
+        if len(kv) != 2 || len(kv[0]) == 0 || len(kv[0]) > 255 ||
+            len(kv[1]) == 0 {
+            logger.Error("tokens", "Ignoring malformed token.keys entry",
+                util.Fields{"key_id": kv[0]})
+            continue
+        }
+        self.keys[kv[0]] = []byte(kv[1])
+        if len(self.current) == 0 {
+            self.current = kv[0]
+        }
+    }
+    if secret := util.MzGet(config, "token.secret", ""); len(secret) > 0 {
+        if _, ok := self.keys["0"]; !ok {
+            self.keys["0"] = []byte(secret)
+        }
+        if len(self.current) == 0 {
+            self.current = "0"
+        }
+    }
+    if kid := util.MzGet(config, "token.key_id", ""); len(kid) > 0 {
+        if _, ok := self.keys[kid]; ok {
+            self.current = kid
+        } else {
+            logger.Error("tokens", "token.key_id is not in token.keys",
+                util.Fields{"key_id": kid})
+        }
+    }
+    if len(self.keys) == 0 {
+        if !util.MzGetFlag(config, "token.dev_random_key") {
+            return nil, errors.New("No token.keys or token.secret set")
+        }
+        logger.Warn("tokens",
+            "token.dev_random_key set, using a random key. Tokens will not survive a restart",
+            nil)
+        buf := make([]byte, 32)
+        if _, err := rand.Read(buf); err != nil {
+            return nil, err
+        }
+        self.keys["0"] = buf
+        self.current = "0"
+    }
+    return self, nil
+}
+
+func (self *tokenKeys) sign(kid string, parts ...[]byte) []byte {
+    mac := hmac.New(sha256.New, self.keys[kid])
+    for _, part := range parts {
+        mac.Write(part)
+    }
+    return mac.Sum(nil)[:macLen]
+}
+
+// Make a new signed presence ID.
+func (self *tokenKeys) mint() (string, error) {
+    var buf bytes.Buffer
+
+    id := make([]byte, tokenIDLen)
+    n, err := rand.Read(id)
+    if n != len(id) || err != nil {
+        return "", err
+    }
+    buf.Write(id)
+    binary.Write(&buf, binary.BigEndian, uint32(time.Now().UTC().Unix()))
+    buf.WriteByte(byte(len(self.current)))
+    buf.WriteString(self.current)
+    buf.Write(self.sign(self.current, buf.Bytes()))
+    return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Decode a token, in either the current or the old form.
+func decodeToken(token string) ([]byte, error) {
+    if len(token) == 0 || len(token) > maxTokenLen {
+        return nil, errMalformedToken
+    }
+    enc := base64.RawURLEncoding
+    if strings.ContainsAny(token, "+/=") {
+        enc = base64.RawStdEncoding
+    }
+    raw, err := enc.DecodeString(strings.TrimRight(token, "="))
+    if err != nil {
+        return nil, errMalformedToken
+    }
+    return raw, nil
+}
+
+// Return the current form of a token.
+func canonicalToken(token string) (string, error) {
+    raw, err := decodeToken(token)
+    if err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// canonicalToken a list of tokens, failing on the first bad one.
+func canonicalTokens(tokens []string) ([]string, error) {
+    canon := make([]string, len(tokens))
+    for i, token := range tokens {
+        var err error
+        if canon[i], err = canonicalToken(token); err != nil {
+            return nil, apiError{"Malformed token: " + token,
+                http.StatusBadRequest}
+        }
+    }
+    return canon, nil
+}
+
+// Check that we issued this presence ID, and return the ID of the key
+// it was signed with.
+func (self *tokenKeys) verify(token string) (kid string, err error) {
+    raw, err := decodeToken(token)
+    if err != nil || len(raw) < tokenIDLen + 4 + 1 + macLen {
+        return "", errMalformedToken
+    }
+    kidLen := int(raw[tokenIDLen + 4])
+    payloadLen := tokenIDLen + 4 + 1 + kidLen
+    if len(raw) != payloadLen + macLen {
+        return "", errMalformedToken
+    }
+    kid = string(raw[tokenIDLen + 5:payloadLen])
+    if _, ok := self.keys[kid]; !ok {
+        return "", errForgedToken
+    }
+    if !hmac.Equal(raw[payloadLen:], self.sign(kid, raw[:payloadLen])) {
+        return "", errForgedToken
+    }
+    issued := int64(binary.BigEndian.Uint32(raw[tokenIDLen:tokenIDLen + 4]))
+    if issued > time.Now().UTC().Unix() + tokenSkew {
+        return "", errForgedToken
+    }
+    return kid, nil
+}
+
+// Return the write key for a presence ID, or "" if it isn't one of ours.
+func (self *tokenKeys) writeKey(token string) string {
+    kid, err := self.verify(token)
+    if err != nil {
+        return ""
+    }
+    canon, _ := canonicalToken(token)
+    return self.keyFor(kid, "write:", canon)
+}
+
+// Return the secret webhook payloads are signed with, or "" if id isn't
+// one of ours.
+func (self *tokenKeys) hookSecret(id string) string {
+    kid, err := self.verify(id)
+    if err != nil {
+        return ""
+    }
+    canon, _ := canonicalToken(id)
+    return self.keyFor(kid, "hook:", canon)
+}
+
+// Return the grant that lets grantee see token, or "" if token isn't
+// one of ours. A grant is "<grantee>.<MAC>", so it says who it's for.
+func (self *tokenKeys) grant(token, grantee string) string {
+    kid, err := self.verify(token)
+    if err != nil {
+        return ""
+    }
+    canon, _ := canonicalToken(token)
+    return grantee + "." + self.keyFor(kid, "grant:" + grantee + ":", canon)
+}
+
+// Is grant one that token made? Returns who it was made for.
+func (self *tokenKeys) checkGrant(token, grant string) (grantee string, ok bool) {
+    dot := strings.LastIndex(grant, ".")
+    if dot < 1 {
+        return "", false
+    }
+    grantee = grant[:dot]
+    want := self.grant(token, grantee)
+    if len(want) == 0 || !hmac.Equal([]byte(grant), []byte(want)) {
+        return "", false
+    }
+    return grantee, true
+}
+
+func (self *tokenKeys) keyFor(kid, purpose, token string) string {
+    return base64.RawURLEncoding.EncodeToString(
+        self.sign(kid, []byte(purpose), []byte(token)))
+}
+
+// Is key the write key for token?
+func (self *tokenKeys) check(token, key string) bool {
+    kid, err := self.verify(token)
+    if len(key) == 0 || err != nil {
+        return false
+    }
+    raw, _ := decodeToken(token)
+    // Keys handed out with old style tokens were made from that form.
+    for _, form := range []string{base64.RawURLEncoding.EncodeToString(raw),
+        base64.StdEncoding.EncodeToString(raw)} {
+        if hmac.Equal([]byte(key), []byte(self.keyFor(kid, "write:", form))) {
+            return true
+        }
+    }
+    return false
+}
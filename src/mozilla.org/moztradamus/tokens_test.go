@@ -0,0 +1,144 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+
+    "bytes"
+    "encoding/base64"
+    "encoding/binary"
+    "testing"
+    "time"
+)
+
+func testKeys(t *testing.T, keys string) *tokenKeys {
+    tk, err := newTokenKeys(util.JsMap{"token.keys": keys}, testLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tk
+}
+
+// A token as mint makes them, but issued whenever we like.
+func tokenAt(tk *tokenKeys, kid string, issued int64) string {
+    var buf bytes.Buffer
+
+    buf.Write(make([]byte, tokenIDLen))
+    binary.Write(&buf, binary.BigEndian, uint32(issued))
+    buf.WriteByte(byte(len(kid)))
+    buf.WriteString(kid)
+    buf.Write(tk.sign(kid, buf.Bytes()))
+    return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// The pre-URL safe form of a token.
+func oldForm(token string) string {
+    raw, _ := base64.RawURLEncoding.DecodeString(token)
+    return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestNewTokenKeys(t *testing.T) {
+    logger := testLogger()
+    tests := []struct {
+        name    string
+        config  util.JsMap
+        current string
+        ok      bool
+    }{
+        {"none", util.JsMap{}, "", false},
+        {"malformed only", util.JsMap{"token.keys": "nokey,:x,y:"}, "",
+            false},
+        {"first is current", util.JsMap{"token.keys": "a:1, b:2"}, "a",
+            true},
+        {"key_id", util.JsMap{"token.keys": "a:1,b:2",
+            "token.key_id": "b"}, "b", true},
+        {"unknown key_id", util.JsMap{"token.keys": "a:1",
+            "token.key_id": "z"}, "a", true},
+        {"secret", util.JsMap{"token.secret": "s"}, "0", true},
+        {"dev key", util.JsMap{"token.dev_random_key": "true"}, "0", true},
+    }
+    for _, test := range tests {
+        tk, err := newTokenKeys(test.config, logger)
+        if (err == nil) != test.ok {
+            t.Errorf("%s: got error %v", test.name, err)
+            continue
+        }
+        if test.ok && tk.current != test.current {
+            t.Errorf("%s: current key %q, want %q", test.name, tk.current,
+                test.current)
+        }
+    }
+}
+
+func TestVerifyToken(t *testing.T) {
+    old := testKeys(t, "1:old")
+    tk := testKeys(t, "2:new,1:old")
+    other := testKeys(t, "2:other")
+    now := time.Now().UTC().Unix()
+
+    minted, err := tk.mint()
+    if err != nil {
+        t.Fatal(err)
+    }
+    fromOld, _ := old.mint()
+    raw, _ := base64.RawURLEncoding.DecodeString(minted)
+    raw[len(raw) - 1] ^= 1
+    tampered := base64.RawURLEncoding.EncodeToString(raw)
+
+    tests := []struct {
+        name  string
+        keys  *tokenKeys
+        token string
+        kid   string
+        err   error
+    }{
+        {"minted", tk, minted, "2", nil},
+        {"old form", tk, oldForm(minted), "2", nil},
+        {"older key", tk, fromOld, "1", nil},
+        {"dropped key", other, fromOld, "", errForgedToken},
+        {"other secret", other, minted, "", errForgedToken},
+        {"tampered", tk, tampered, "", errForgedToken},
+        {"skewed", tk, tokenAt(tk, "2", now + 60), "2", nil},
+        {"from the future", tk, tokenAt(tk, "2", now + 3600), "",
+            errForgedToken},
+        {"truncated", tk, minted[:20], "", errMalformedToken},
+        {"padded", tk, minted + "AA", "", errMalformedToken},
+        {"not base64", tk, "not a token!", "", errMalformedToken},
+        {"empty", tk, "", "", errMalformedToken},
+    }
+    for _, test := range tests {
+        kid, err := test.keys.verify(test.token)
+        if err != test.err || kid != test.kid {
+            t.Errorf("%s: got (%q, %v), want (%q, %v)", test.name, kid, err,
+                test.kid, test.err)
+        }
+    }
+}
+
+func TestCheckWriteKey(t *testing.T) {
+    tk := testKeys(t, "1:secret")
+    token, _ := tk.mint()
+    another, _ := tk.mint()
+    key := tk.writeKey(token)
+    // keys handed out with old style tokens were made from that form.
+    oldKey := tk.keyFor("1", "write:", oldForm(token))
+
+    tests := []struct {
+        name  string
+        token string
+        key   string
+        ok    bool
+    }{
+        {"right key", token, key, true},
+        {"old form token", oldForm(token), key, true},
+        {"old style key", token, oldKey, true},
+        {"empty key", token, "", false},
+        {"wrong key", token, key[1:] + "A", false},
+        {"another token's key", another, key, false},
+        {"forged token", "AAAA" + token[4:], key, false},
+    }
+    for _, test := range tests {
+        if ok := tk.check(test.token, test.key); ok != test.ok {
+            t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+        }
+    }
+}
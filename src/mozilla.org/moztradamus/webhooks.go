@@ -0,0 +1,576 @@
+package moztradamus
+
+// Webhooks: POST to a URL when watched tokens come online or go offline.
+
+/** A hook is a URL and the tokens it cares about. Its ID is minted like
+ * a token, so it has a write key too, which is needed to change or
+ * delete it. Payloads are JSON, signed with a secret that's handed out
+ * when the hook is made:
+ *
+ *   X-Presence-Signature: sha256=<hex HMAC-SHA256 of the body>
+ *
+ * "Online" is present and visible; anything else (expired, offline,
+ * invisible, revoked, rotated) is "offline". Only changes are sent.
+ *
+ * Deliveries go through a queue ("webhook.queue") to a few workers
+ * ("webhook.workers"). A delivery that fails (no 2xx within
+ * "webhook.timeout") is retried "webhook.retries" times, waiting
+ * "webhook.backoff", then twice that, and so on. One that still fails
+ * (or finds the queue full) is written to the dead letter log,
+ * "webhook.dead_letter", one JSON object per line.
+ *
+ * Hooks are kept in "webhook.path" so they survive a restart: each
+ * change is appended to it as a line of JSON (a removal is just the ID
+ * and "deleted"), and it's rewritten with only the live hooks when the
+ * server starts. Like /1/stream/, they only hear about pings handled by
+ * this server.
+ *
+ * Each hook watches its tokens for as long as it's there, so no token
+ * may be in more than "webhook.max_per_token" hooks (default 10), and
+ * making one counts against the client's address as a request does.
+ *
+ * Private tokens are only seen if the hook was made "as" a grantee (with
+ * its key) or with "grants" for them.
+ *
+ * Off unless "webhook.enabled" is set, since it lets anyone make the
+ * server POST to any URL.
+ */
+
+import(
+    "mozilla.org/util"
+
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    hookOnline  = "online"
+    hookOffline = "offline"
+)
+
+type webhook struct {
+    ID     string   `json:"id"`
+    URL    string   `json:"url"`
+    Tokens []string `json:"tokens"`
+    // who the hook sees private tokens as (see grants.go).
+    As     string            `json:"as,omitempty"`
+    Grants map[string]string `json:"grants,omitempty"`
+    // (only in webhook.path: the hook was removed.)
+    Deleted bool `json:"deleted,omitempty"`
+}
+
+// What gets POSTed.
+type hookPayload struct {
+    Hook  string `json:"hook"`
+    Token string `json:"token"`
+    // online or offline
+    Event string `json:"event"`
+    // the /poll/ state behind it.
+    State  string `json:"state"`
+    Status string `json:"status,omitempty"`
+    Time   int64  `json:"time"`
+}
+
+type hookDelivery struct {
+    id      string
+    url     string
+    body    []byte
+    attempt int
+}
+
+// A hook, and the goroutine watching its tokens.
+type hookRun struct {
+    hook webhook
+    stop chan bool
+}
+
+type webhooks struct {
+    sync.Mutex
+    handler     *Handler
+    logger      *util.HekaLogger
+    path        string
+    runs        map[string]*hookRun
+    maxPerToken int
+    queue       chan *hookDelivery
+    client      *http.Client
+    retries     int
+    backoff     time.Duration
+    deadLetter  string
+    deadMu      sync.Mutex
+    done        chan bool
+    wg          sync.WaitGroup
+}
+
+func hookDuration(config util.JsMap, key, def string, logger *util.HekaLogger) time.Duration {
+    d, err := time.ParseDuration(util.MzGet(config, key, def))
+    if err != nil || d <= 0 {
+        logger.Error("webhook", "Invalid " + key + ", using " + def, nil)
+        d, _ = time.ParseDuration(def)
+    }
+    return d
+}
+
+func hookInt(config util.JsMap, key, def string, logger *util.HekaLogger) int {
+    n, err := strconv.ParseInt(util.MzGet(config, key, def), 0, 0)
+    if err != nil || n < 0 {
+        logger.Error("webhook", "Invalid " + key + ", using " + def, nil)
+        n, _ = strconv.ParseInt(def, 0, 0)
+    }
+    return int(n)
+}
+
+// Returns nil if webhooks aren't enabled.
+func newWebhooks(config util.JsMap, handler *Handler, logger *util.HekaLogger) *webhooks {
+    if enabled, _ := strconv.ParseBool(util.MzGet(config, "webhook.enabled",
+        "false")); !enabled {
+        return nil
+    }
+    queueLen := hookInt(config, "webhook.queue", "1000", logger)
+    self := &webhooks{handler: handler,
+        logger: logger,
+        path: util.MzGet(config, "webhook.path", "webhooks.json"),
+        runs: make(map[string]*hookRun),
+        maxPerToken: hookInt(config, "webhook.max_per_token", "10", logger),
+        queue: make(chan *hookDelivery, queueLen),
+        client: &http.Client{Timeout: hookDuration(config,
+            "webhook.timeout", "5s", logger)},
+        retries: hookInt(config, "webhook.retries", "5", logger),
+        backoff: hookDuration(config, "webhook.backoff", "1s", logger),
+        deadLetter: util.MzGet(config, "webhook.dead_letter",
+            "webhooks_dead.log"),
+        done: make(chan bool)}
+
+    hooks, err := self.load()
+    if err == nil {
+        err = self.compact(hooks)
+    }
+    if err != nil {
+        logger.Error("webhook", "Could not load webhooks",
+            util.Fields{"path": self.path, "error": err.Error()})
+    }
+    for _, hook := range hooks {
+        self.start(hook)
+    }
+    workers := hookInt(config, "webhook.workers", "4", logger)
+    for i := 0; i < workers; i++ {
+        self.wg.Add(1)
+        go self.worker()
+    }
+    logger.Info("webhook", "Webhooks enabled",
+        util.Fields{"hooks": strconv.Itoa(len(hooks))})
+    return self
+}
+
+// Replay webhook.path; the last line for a hook wins. (A file from
+// before it was a log is a single JSON array.)
+func (self *webhooks) load() ([]webhook, error) {
+    body, err := ioutil.ReadFile(self.path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+        var hooks []webhook
+        err = json.Unmarshal(trimmed, &hooks)
+        return hooks, err
+    }
+    live := make(map[string]webhook)
+    var order []string
+    for _, line := range bytes.Split(body, []byte("\n")) {
+        if len(bytes.TrimSpace(line)) == 0 {
+            continue
+        }
+        var hook webhook
+        if err = json.Unmarshal(line, &hook); err != nil {
+            return nil, err
+        }
+        if _, ok := live[hook.ID]; !ok {
+            order = append(order, hook.ID)
+        }
+        live[hook.ID] = hook
+    }
+    var hooks []webhook
+    for _, id := range order {
+        if hook := live[id]; !hook.Deleted {
+            hooks = append(hooks, hook)
+        }
+    }
+    return hooks, nil
+}
+
+// Start webhook.path over with just hooks.
+func (self *webhooks) compact(hooks []webhook) error {
+    var buf bytes.Buffer
+    for _, hook := range hooks {
+        line, err := json.Marshal(hook)
+        if err != nil {
+            return err
+        }
+        buf.Write(append(line, '\n'))
+    }
+    tmp := self.path + ".tmp"
+    if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, self.path)
+}
+
+// Add a change to webhook.path. Caller must hold the lock.
+func (self *webhooks) save(hook webhook) error {
+    line, err := json.Marshal(hook)
+    if err != nil {
+        return err
+    }
+    file, err := os.OpenFile(self.path,
+        os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err = file.Write(append(line, '\n')); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// Returns the first of hook's tokens that's already in as many other
+// hooks as it may be, if any. Caller must hold the lock.
+func (self *webhooks) overLimit(hook webhook) (string, bool) {
+    if self.maxPerToken == 0 {
+        return "", false
+    }
+    counts := make(map[string]int)
+    for id, run := range self.runs {
+        if id == hook.ID {
+            continue
+        }
+        for _, token := range run.hook.Tokens {
+            counts[token]++
+        }
+    }
+    for _, token := range hook.Tokens {
+        if counts[token] >= self.maxPerToken {
+            return token, true
+        }
+    }
+    return "", false
+}
+
+// Start watching for a hook. Caller must hold the lock (or be
+// starting up).
+func (self *webhooks) start(hook webhook) {
+    run := &hookRun{hook: hook, stop: make(chan bool)}
+    self.runs[hook.ID] = run
+    self.wg.Add(1)
+    go self.watch(run)
+}
+
+// Add or replace a hook. Returns an apiError if one of its tokens is in
+// too many hooks already; any other error is from saving it.
+func (self *webhooks) put(hook webhook) error {
+    self.Lock()
+    defer self.Unlock()
+    if token, over := self.overLimit(hook); over {
+        return apiError{"Too many webhooks for token: " + token,
+            http.StatusConflict}
+    }
+    if run, ok := self.runs[hook.ID]; ok {
+        close(run.stop)
+    }
+    self.start(hook)
+    return self.save(hook)
+}
+
+// Returns false if there was no such hook.
+func (self *webhooks) remove(id string) (bool, error) {
+    self.Lock()
+    defer self.Unlock()
+    run, ok := self.runs[id]
+    if !ok {
+        return false, nil
+    }
+    close(run.stop)
+    delete(self.runs, id)
+    return true, self.save(webhook{ID: id, Deleted: true})
+}
+
+// Watch a hook's tokens and queue a delivery when one comes or goes.
+func (self *webhooks) watch(run *hookRun) {
+    defer self.wg.Done()
+    online := make(map[string]bool)
+    first := true
+    view := &viewer{token: run.hook.As, grants: run.hook.Grants}
+    screen := self.handler.screen(view)
+    for {
+        sub, current := self.handler.watch(run.hook.Tokens, view)
+        // Only the first look is taken as is; after that we may have
+        // missed something, so compare.
+        now := time.Now().UTC().Unix()
+        for _, reply := range current {
+            up := reply.State == statePresent
+            if !first && up != online[reply.Token] {
+                self.send(run.hook, reply, up, now)
+            }
+            online[reply.Token] = up
+        }
+        first = false
+        for lagging := false; !lagging; {
+            select {
+            case ev, ok := <-sub.C:
+                if !ok {
+                    self.logger.Warn("webhook", "Fell behind, resubscribing",
+                        util.Fields{"hook": run.hook.ID})
+                    lagging = true
+                    break
+                }
+                now = time.Now().UTC().Unix()
+                _, reply, send := screen.pass(ev, now)
+                if !send {
+                    break
+                }
+                up := reply.State == statePresent
+                if up != online[reply.Token] {
+                    online[reply.Token] = up
+                    self.send(run.hook, reply, up, now)
+                }
+            case <-run.stop:
+                sub.Close()
+                return
+            case <-self.done:
+                sub.Close()
+                return
+            }
+        }
+        sub.Close()
+    }
+}
+
+func (self *webhooks) send(hook webhook, reply streamEvent, up bool, now int64) {
+    payload := hookPayload{Hook: hook.ID,
+        Token: reply.Token,
+        Event: hookOffline,
+        State: reply.State,
+        Time: now}
+    if up {
+        payload.Event = hookOnline
+        payload.Status = reply.Status
+    }
+    body, err := json.Marshal(payload)
+    if err != nil {
+        self.logger.Error("webhook", "Could not encode payload",
+            util.Fields{"hook": hook.ID, "error": err.Error()})
+        return
+    }
+    self.enqueue(&hookDelivery{id: hook.ID, url: hook.URL, body: body})
+}
+
+func (self *webhooks) enqueue(d *hookDelivery) {
+    select {
+    case self.queue <- d:
+    default:
+        self.dead(d, "queue full")
+    }
+}
+
+func (self *webhooks) worker() {
+    defer self.wg.Done()
+    for {
+        select {
+        case d := <-self.queue:
+            err := self.deliver(d)
+            if err == nil {
+                continue
+            }
+            d.attempt++
+            if d.attempt > self.retries {
+                self.dead(d, err.Error())
+                continue
+            }
+            self.logger.Debug("webhook", "Delivery failed, will retry",
+                util.Fields{"hook": d.id,
+                    "attempt": strconv.Itoa(d.attempt),
+                    "error": err.Error()})
+            time.AfterFunc(self.backoff << uint(d.attempt - 1), func() {
+                self.enqueue(d)
+            })
+        case <-self.done:
+            return
+        }
+    }
+}
+
+func (self *webhooks) deliver(d *hookDelivery) error {
+    req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.body))
+    if err != nil {
+        return err
+    }
+    mac := hmac.New(sha256.New, []byte(self.handler.keys.hookSecret(d.id)))
+    mac.Write(d.body)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Presence-Hook", d.id)
+    req.Header.Set("X-Presence-Signature",
+        "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+    resp, err := self.client.Do(req)
+    if err != nil {
+        return err
+    }
+    io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("%s returned %s", d.url, resp.Status)
+    }
+    return nil
+}
+
+// Give up on a delivery, and note it in the dead letter log.
+func (self *webhooks) dead(d *hookDelivery, reason string) {
+    self.logger.Warn("webhook", "Giving up on delivery",
+        util.Fields{"hook": d.id, "url": d.url, "error": reason})
+    line, _ := json.Marshal(struct {
+        Time     int64           `json:"time"`
+        URL      string          `json:"url"`
+        Attempts int             `json:"attempts"`
+        Error    string          `json:"error"`
+        Payload  json.RawMessage `json:"payload"`
+    }{time.Now().UTC().Unix(), d.url, d.attempt, reason, d.body})
+
+    self.deadMu.Lock()
+    defer self.deadMu.Unlock()
+    file, err := os.OpenFile(self.deadLetter,
+        os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        self.logger.Error("webhook", "Could not open dead letter log",
+            util.Fields{"path": self.deadLetter, "error": err.Error()})
+        return
+    }
+    defer file.Close()
+    file.Write(append(line, '\n'))
+}
+
+// Stop watching and delivering. Queued deliveries are dropped.
+func (self *webhooks) Close() {
+    close(self.done)
+    self.wg.Wait()
+}
+
+type webhookRequest struct {
+    // leave out ID (and Key) to make a new hook.
+    ID     string   `json:"id"`
+    Key    string   `json:"key"`
+    URL    string   `json:"url"`
+    Tokens []string `json:"tokens"`
+    As     *tokenRequest     `json:"as"`
+    Grants map[string]string `json:"grants"`
+}
+
+type webhookResponse struct {
+    ID     string   `json:"id"`
+    Key    string   `json:"key,omitempty"`
+    Secret string   `json:"secret,omitempty"`
+    URL    string   `json:"url,omitempty"`
+    Tokens []string `json:"tokens,omitempty"`
+    Deleted bool    `json:"deleted,omitempty"`
+}
+
+// POST /1/webhook/ {"url":..., "tokens":[...]} makes a hook (add "id"
+// and "key" to change one). DELETE /1/webhook/<id> (with the key, as
+// for DELETE /0/ping/) removes it.
+func (self *Handler) WebhookHandler(resp http.ResponseWriter, req *http.Request) {
+    if self.hooks == nil {
+        self.jsonErr(resp, "Webhooks are not enabled", http.StatusNotFound)
+        return
+    }
+    if req.Method == "DELETE" {
+        id, err := self.authorize(pathToken(req.URL.Path), writeKey(req))
+        if err != nil {
+            aerr := err.(apiError)
+            self.jsonErr(resp, aerr.msg, aerr.status)
+            return
+        }
+        found, err := self.hooks.remove(id)
+        if err != nil {
+            self.logger.Error("webhook", "Could not save webhooks",
+                util.Fields{"error": err.Error()})
+        }
+        if !found {
+            self.jsonErr(resp, "No such webhook", http.StatusNotFound)
+            return
+        }
+        self.jsonReply(resp, webhookResponse{ID: id, Deleted: true},
+            http.StatusOK)
+        return
+    }
+
+    if !self.allowRequest(resp, req, self.jsonErr) {
+        return
+    }
+    var wr webhookRequest
+    if !self.readJSONUpTo(resp, req, &wr, self.poll.maxBody) {
+        return
+    }
+    target, err := url.Parse(wr.URL)
+    if err != nil || (target.Scheme != "http" && target.Scheme != "https") ||
+        len(target.Host) == 0 {
+        self.jsonErr(resp, "Invalid url", http.StatusBadRequest)
+        return
+    }
+    if len(wr.Tokens) == 0 {
+        self.jsonErr(resp, "No tokens", http.StatusBadRequest)
+        return
+    }
+    if len(wr.Tokens) > self.stream.maxTokens {
+        self.jsonErr(resp, "Too many tokens", http.StatusRequestEntityTooLarge)
+        return
+    }
+    tokens, err := canonicalTokens(wr.Tokens)
+    if err != nil {
+        self.jsonErr(resp, err.Error(), http.StatusBadRequest)
+        return
+    }
+    view, err := self.viewerFor(wr.As, wr.Grants)
+    if err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+
+    reply := webhookResponse{URL: wr.URL, Tokens: tokens}
+    if len(wr.ID) == 0 {
+        if reply.ID, reply.Key, err = self.newToken(); err != nil {
+            self.jsonErr(resp, "Could not create webhook",
+                http.StatusInternalServerError)
+            return
+        }
+        reply.Secret = self.keys.hookSecret(reply.ID)
+    } else if reply.ID, err = self.authorize(wr.ID, wr.Key); err != nil {
+        aerr := err.(apiError)
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    err = self.hooks.put(webhook{ID: reply.ID, URL: wr.URL,
+        Tokens: tokens, As: view.token, Grants: view.grants})
+    if aerr, ok := err.(apiError); ok {
+        self.jsonErr(resp, aerr.msg, aerr.status)
+        return
+    }
+    if err != nil {
+        // it's running, it just won't survive a restart.
+        self.logger.Error("webhook", "Could not save webhooks",
+            util.Fields{"error": err.Error()})
+    }
+    self.jsonReply(resp, reply, http.StatusOK)
+}
@@ -0,0 +1,202 @@
+package moztradamus
+
+import(
+    "mozilla.org/util"
+
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func webhookConfig(t *testing.T) util.JsMap {
+    dir := t.TempDir()
+    return util.JsMap{"webhook.enabled": "true",
+        "webhook.path": filepath.Join(dir, "webhooks.json"),
+        "webhook.dead_letter": filepath.Join(dir, "dead.log"),
+        "webhook.max_per_token": "1",
+        // (flipUntil pings faster than a token may.)
+        "ratelimit.token.rate": "0"}
+}
+
+func makeHook(t *testing.T, h *Handler, body string) (int, webhookResponse) {
+    var reply webhookResponse
+    code := call(t, h.WebhookHandler, body, &reply)
+    return code, reply
+}
+
+func TestWebhookLimits(t *testing.T) {
+    config := webhookConfig(t)
+    h := testHandler(t, config)
+    a, _ := h.keys.mint()
+    b, _ := h.keys.mint()
+
+    code, first := makeHook(t, h,
+        `{"url":"http://127.0.0.1:1/","tokens":["` + a + `"]}`)
+    if code != http.StatusOK {
+        t.Fatalf("first hook: got %d", code)
+    }
+    if code, _ := makeHook(t, h,
+        `{"url":"http://127.0.0.1:1/","tokens":["` + b + `","` + a + `"]}`); code != http.StatusConflict {
+        t.Errorf("second hook on a token: got %d, want 409", code)
+    }
+    // changing a hook doesn't count it twice.
+    if code, _ := makeHook(t, h, `{"id":"` + first.ID + `","key":"` +
+        first.Key + `","url":"http://127.0.0.1:2/","tokens":["` + a +
+        `"]}`); code != http.StatusOK {
+        t.Errorf("changing the hook: got %d", code)
+    }
+    code, second := makeHook(t, h,
+        `{"url":"http://127.0.0.1:1/","tokens":["` + b + `"]}`)
+    if code != http.StatusOK {
+        t.Fatalf("hook on another token: got %d", code)
+    }
+    resp := httptest.NewRecorder()
+    h.WebhookHandler(resp, httptest.NewRequest("DELETE",
+        "/1/webhook/" + first.ID + "?key=" + first.Key, nil))
+    if resp.Code != http.StatusOK {
+        t.Fatalf("delete: got %d", resp.Code)
+    }
+
+    // the log has a line per change, and replays to what's left.
+    hooks, err := h.hooks.load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(hooks) != 1 || hooks[0].ID != second.ID {
+        t.Errorf("replayed %+v, want just %s", hooks, second.ID)
+    }
+    // and starting up again leaves just that.
+    again := newWebhooks(config, h, testLogger())
+    again.Close()
+    body, _ := ioutil.ReadFile(config["webhook.path"].(string))
+    if hooks, err := again.load(); err != nil || len(hooks) != 1 ||
+        len(body) == 0 || body[len(body) - 1] != '\n' ||
+        len(hooks[0].Tokens) != 1 || hooks[0].Tokens[0] != b {
+        t.Errorf("after compacting: got %+v, %v (%q)", hooks, err, body)
+    }
+}
+
+// A file written before webhook.path was a log still loads.
+func TestWebhookLoadArray(t *testing.T) {
+    config := webhookConfig(t)
+    path := config["webhook.path"].(string)
+    if err := ioutil.WriteFile(path,
+        []byte(`[{"id":"x","url":"http://127.0.0.1:1/","tokens":["t"]}]`),
+        0600); err != nil {
+        t.Fatal(err)
+    }
+    hooks, err := (&webhooks{path: path}).load()
+    if err != nil || len(hooks) != 1 || hooks[0].ID != "x" {
+        t.Errorf("got %+v, %v", hooks, err)
+    }
+}
+
+type delivery struct {
+    header http.Header
+    body   []byte
+}
+
+// Flip a token on and offline until heard says a hook got word of it
+// (the hook watches from a goroutine of its own, so it may miss the
+// first few), or five seconds go by.
+func flipUntil(t *testing.T, h *Handler, ping pingResponse, heard func() bool) {
+    auth := `{"token":"` + ping.Token + `","key":"` + ping.Key + `"}`
+    deadline := time.Now().Add(5 * time.Second)
+    for !heard() {
+        if time.Now().After(deadline) {
+            t.Fatal("no delivery")
+        }
+        call(t, h.V1OfflineHandler, auth, nil)
+        time.Sleep(20 * time.Millisecond)
+        call(t, h.V1PingHandler, auth, nil)
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+func TestWebhookDelivery(t *testing.T) {
+    got := make(chan delivery, 100)
+    server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+        body, _ := ioutil.ReadAll(req.Body)
+        got <- delivery{req.Header, body}
+    }))
+    defer server.Close()
+    h := testHandler(t, webhookConfig(t))
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{}`, &ping)
+    code, hook := makeHook(t, h, `{"url":"` + server.URL + `","tokens":["` +
+        ping.Token + `"]}`)
+    if code != http.StatusOK || len(hook.Secret) == 0 {
+        t.Fatalf("got %d, %+v", code, hook)
+    }
+
+    var d delivery
+    flipUntil(t, h, ping, func() bool {
+        select {
+        case d = <-got:
+            return true
+        default:
+            return false
+        }
+    })
+    mac := hmac.New(sha256.New, []byte(hook.Secret))
+    mac.Write(d.body)
+    if sig := d.header.Get("X-Presence-Signature"); sig !=
+        "sha256=" + hex.EncodeToString(mac.Sum(nil)) {
+        t.Errorf("bad signature %s", sig)
+    }
+    var payload hookPayload
+    if err := json.Unmarshal(d.body, &payload); err != nil {
+        t.Fatal(err)
+    }
+    if payload.Hook != hook.ID || payload.Token != ping.Token ||
+        d.header.Get("X-Presence-Hook") != hook.ID {
+        t.Errorf("got %+v", payload)
+    }
+    if (payload.Event == hookOnline) != (payload.State == statePresent) {
+        t.Errorf("%s for state %s", payload.Event, payload.State)
+    }
+}
+
+// Deliveries that keep failing end up in the dead letter log.
+func TestWebhookDeadLetter(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+        http.Error(resp, "no", http.StatusInternalServerError)
+    }))
+    defer server.Close()
+    config := webhookConfig(t)
+    config["webhook.retries"] = "1"
+    config["webhook.backoff"] = "10ms"
+    h := testHandler(t, config)
+    var ping pingResponse
+    call(t, h.V1PingHandler, `{}`, &ping)
+    makeHook(t, h, `{"url":"` + server.URL + `","tokens":["` +
+        ping.Token + `"]}`)
+
+    var line struct {
+        URL      string `json:"url"`
+        Attempts int    `json:"attempts"`
+    }
+    flipUntil(t, h, ping, func() bool {
+        body, _ := ioutil.ReadFile(config["webhook.dead_letter"].(string))
+        if len(body) == 0 {
+            return false
+        }
+        first := bytes.SplitN(body, []byte("\n"), 2)[0]
+        if err := json.Unmarshal(first, &line); err != nil {
+            t.Fatalf("%s: %s", err, first)
+        }
+        return true
+    })
+    if line.URL != server.URL || line.Attempts != 2 {
+        t.Errorf("got %+v", line)
+    }
+}
+
@@ -16,6 +16,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,7 +29,7 @@ type HekaLogger struct {
 	hostname string
 	conf     JsMap
 	tracer   bool
-	filter   int64
+	filter   int64 // atomic, SetFilter may change it
 }
 
 // Message levels
@@ -120,7 +121,7 @@ func addFields(msg *message.Message, fields Fields) (err error) {
 // mtype - Message type, Short class identifier for the message
 // payload - Main error message
 // fields - additional optional key/value data associated with the message.
-func (self HekaLogger) Log(level int32, mtype, payload string, fields Fields) (err error) {
+func (self *HekaLogger) Log(level int32, mtype, payload string, fields Fields) (err error) {
 
 	var caller Fields
 	// add in go language tracing. (Also CPU intensive, but REALLY helpful
@@ -136,7 +137,7 @@ func (self HekaLogger) Log(level int32, mtype, payload string, fields Fields) (e
 	}
 
 	// Only print out the debug message if it's less than the filter.
-	if int64(level) < self.filter {
+	if int64(level) < atomic.LoadInt64(&self.filter) {
 		dump := fmt.Sprintf("[%d]% 7s: %s", level, mtype, payload)
 		if len(fields) > 0 {
 			var fld []string
@@ -192,27 +193,40 @@ func (self HekaLogger) Log(level int32, mtype, payload string, fields Fields) (e
 }
 
 // record the lowest priority message
-func (self HekaLogger) Info(mtype, msg string, fields Fields) (err error) {
+func (self *HekaLogger) Info(mtype, msg string, fields Fields) (err error) {
 	return self.Log(INFO, mtype, msg, fields)
 }
 
-func (self HekaLogger) Debug(mtype, msg string, fields Fields) (err error) {
+func (self *HekaLogger) Debug(mtype, msg string, fields Fields) (err error) {
 	return self.Log(DEBUG, mtype, msg, fields)
 }
 
-func (self HekaLogger) Warn(mtype, msg string, fields Fields) (err error) {
+func (self *HekaLogger) Warn(mtype, msg string, fields Fields) (err error) {
 	return self.Log(WARNING, mtype, msg, fields)
 }
 
-func (self HekaLogger) Error(mtype, msg string, fields Fields) (err error) {
+func (self *HekaLogger) Error(mtype, msg string, fields Fields) (err error) {
 	return self.Log(ERROR, mtype, msg, fields)
 }
 
 // record the Highest priority message, and include a printstack to STDERR
-func (self HekaLogger) Critical(mtype, msg string, fields Fields) (err error) {
+func (self *HekaLogger) Critical(mtype, msg string, fields Fields) (err error) {
 	debug.PrintStack()
 	return self.Log(CRITICAL, mtype, msg, fields)
 }
 
+// Change the logging level ("logger.filter"), e.g. on a config reload.
+func (self *HekaLogger) SetFilter(filter int64) {
+	atomic.StoreInt64(&self.filter, filter)
+}
+
+// Close the connection to Heka. Messages are sent as they're logged, so
+// there's nothing left waiting to go.
+func (self *HekaLogger) Close() {
+	if self.sender != nil {
+		self.sender.Close()
+	}
+}
+
 // o4fs
 // vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab